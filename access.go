@@ -0,0 +1,173 @@
+package sshd
+
+import (
+	"net"
+	"os/user"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/gliderlabs/ssh"
+	"github.com/inoc603/go-sshd/auth"
+	"github.com/pkg/errors"
+)
+
+// RootLogin is how root may log in.
+type RootLogin int
+
+const (
+	// RootLoginYes lets root log in like any other user.
+	RootLoginYes RootLogin = iota
+	// RootLoginProhibitPassword lets root log in with public keys only.
+	RootLoginProhibitPassword
+	// RootLoginForcedCommandsOnly lets root log in with public keys only, and
+	// only if a command is forced.
+	RootLoginForcedCommandsOnly
+	// RootLoginNo doesn't let root log in.
+	RootLoginNo
+)
+
+// ParseRootLogin parses the values of PermitRootLogin in sshd_config: yes,
+// prohibit-password (or without-password), forced-commands-only and no.
+func ParseRootLogin(s string) (RootLogin, error) {
+	switch strings.ToLower(s) {
+	case "yes":
+		return RootLoginYes, nil
+	case "prohibit-password", "without-password":
+		return RootLoginProhibitPassword, nil
+	case "forced-commands-only":
+		return RootLoginForcedCommandsOnly, nil
+	case "no":
+		return RootLoginNo, nil
+	}
+	return 0, errors.Errorf("invalid root login %q", s)
+}
+
+// matchUser reports whether pattern matches the user connecting from addr.
+// Like OpenSSH, a pattern of the form user@host also has to match the address
+// of the client.
+func matchUser(pattern, name string, addr net.Addr) bool {
+	if i := strings.LastIndex(pattern, "@"); i >= 0 {
+		host, _ := hostPort(addr)
+		if ok, _ := path.Match(pattern[i+1:], host); !ok {
+			return false
+		}
+		pattern = pattern[:i]
+	}
+	ok, _ := path.Match(pattern, name)
+	return ok
+}
+
+func matchAnyUser(patterns []string, name string, addr net.Addr) bool {
+	for _, p := range patterns {
+		if matchUser(p, name, addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// groupNames returns the names of the groups of u, skipping groups without a
+// name.
+func groupNames(u *auth.User) []string {
+	var names []string
+	for _, gid := range u.GroupIDs() {
+		g, err := user.LookupGroupId(strconv.FormatUint(uint64(gid), 10))
+		if err != nil {
+			continue
+		}
+		names = append(names, g.Name)
+	}
+	return names
+}
+
+// userAllowed checks the user of ctx against the users and groups allowed to
+// log in, in the order of OpenSSH: DenyUsers, AllowUsers, DenyGroups and
+// AllowGroups.
+func (s *Server) userAllowed(ctx ssh.Context) bool {
+	name := ctx.User()
+	l := logrus.WithFields(logrus.Fields{
+		"user":       name,
+		"session_id": ctx.SessionID(),
+	})
+
+	if matchAnyUser(s.denyUsers, name, ctx.RemoteAddr()) {
+		l.Warnln("User denied by DenyUsers")
+		return false
+	}
+
+	if len(s.allowUsers) > 0 && !matchAnyUser(s.allowUsers, name, ctx.RemoteAddr()) {
+		l.Warnln("User not allowed by AllowUsers")
+		return false
+	}
+
+	if len(s.denyGroups) == 0 && len(s.allowGroups) == 0 {
+		return true
+	}
+
+	u, err := s.userStore.Get(name)
+	if err != nil {
+		l.WithError(err).Warnln("User denied, groups unknown")
+		return false
+	}
+	groups := groupNames(u)
+
+	for _, g := range groups {
+		if len(s.denyGroups) > 0 && matchAny(s.denyGroups, g) {
+			l.WithField("group", g).Warnln("User denied by DenyGroups")
+			return false
+		}
+	}
+
+	if len(s.allowGroups) == 0 {
+		return true
+	}
+	for _, g := range groups {
+		if matchAny(s.allowGroups, g) {
+			return true
+		}
+	}
+	l.Warnln("User not allowed by AllowGroups")
+	return false
+}
+
+// rootAllowed reports whether the user of ctx may log in with the given
+// method, password or publickey, if the user is root. fingerprint is that of
+// the key the client authenticated with, and forced tells whether the key
+// forces a command.
+func (s *Server) rootAllowed(ctx ssh.Context, method, fingerprint string, forced bool) bool {
+	if s.permitRootLogin == RootLoginYes {
+		return true
+	}
+
+	u, err := s.userStore.Get(ctx.User())
+	if err != nil || u.UID != 0 {
+		return true
+	}
+
+	switch s.permitRootLogin {
+	case RootLoginProhibitPassword:
+		return method == "publickey"
+	case RootLoginForcedCommandsOnly:
+		// A match rule may force a command too, or remove the forced one.
+		settings, _ := s.matchSettings(ctx, method, fingerprint)
+		return method == "publickey" && (settings.forceCommand != "" || forced)
+	}
+	return false
+}
+
+// allowed runs the checks shared by all authentication methods. fingerprint
+// is that of the key the client authenticated with, and forced tells whether
+// the key forces a command.
+func (s *Server) allowed(ctx ssh.Context, method, fingerprint string, forced bool) bool {
+	if !s.rootAllowed(ctx, method, fingerprint, forced) {
+		logrus.WithFields(logrus.Fields{
+			"user":       ctx.User(),
+			"session_id": ctx.SessionID(),
+			"method":     method,
+		}).Warnln("Root login refused")
+		return false
+	}
+	return s.userAllowed(ctx)
+}
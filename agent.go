@@ -0,0 +1,65 @@
+package sshd
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/gliderlabs/ssh"
+	"github.com/inoc603/go-sshd/auth"
+	"github.com/inoc603/go-sshd/fsuser"
+	"github.com/pkg/errors"
+)
+
+// agentAllowed reports whether the user of ctx may forward their agent into
+// sessions.
+func (s *Server) agentAllowed(ctx ssh.Context) bool {
+	if !s.settings(ctx).agentForwarding {
+		return false
+	}
+	return len(s.noAgentUsers) == 0 || !matchAny(s.noAgentUsers, ctx.User())
+}
+
+// forwardAgent creates a socket for the agent the client forwarded, and
+// returns its path along with a function removing it once the session is over.
+// The socket is created with the credentials of the user, so only they and
+// root can use it.
+func (s *Server) forwardAgent(session ssh.Session, user *auth.User) (string, func(), error) {
+	var dir string
+	var ln net.Listener
+	err := fsuser.Run(user, func() (err error) {
+		if dir, err = ioutil.TempDir("", "ssh-"); err != nil {
+			return err
+		}
+		if ln, err = net.Listen("unix", filepath.Join(dir, "agent.sock")); err != nil {
+			os.Remove(dir)
+			return err
+		}
+		// The socket is removed with the directory, as the user rather than
+		// by Close as root.
+		ln.(*net.UnixListener).SetUnlinkOnClose(false)
+		return nil
+	})
+	if err != nil {
+		return "", nil, errors.Wrap(err, "create agent socket")
+	}
+
+	go ssh.ForwardAgentConnections(ln, session)
+
+	l := logrus.WithFields(logrus.Fields{
+		"user":       session.User(),
+		"session_id": session.Context().(ssh.Context).SessionID(),
+		"socket":     ln.Addr().String(),
+	})
+	l.Infoln("Agent forwarding started")
+
+	return ln.Addr().String(), func() {
+		ln.Close()
+		fsuser.Run(user, func() error {
+			return os.RemoveAll(dir)
+		})
+		l.Infoln("Agent forwarding stopped")
+	}, nil
+}
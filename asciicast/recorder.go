@@ -3,11 +3,13 @@ package asciicast
 import (
 	"encoding/json"
 	"io"
+	"sync"
 	"time"
 )
 
 // Recorder records terminal session with the v2 asciicast file format
 type Recorder struct {
+	mu            sync.Mutex
 	recordStdin   bool
 	raw           bool
 	idleTimeLimit time.Duration
@@ -71,6 +73,9 @@ func (r *Recorder) WriteHeader(h Header) error {
 }
 
 func (r *Recorder) log(src string, content []byte) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
 	if r.lastWrite.IsZero() {
 		r.lastWrite = time.Now()
 	} else {
@@ -97,3 +102,29 @@ func (r *Recorder) log(src string, content []byte) error {
 func (r *Recorder) WriteInput(b []byte) { r.log("i", b) }
 
 func (r *Recorder) WriteOutput(b []byte) { r.log("o", b) }
+
+// WriteEvent records something that happened in the session other than
+// terminal input and output, like a file being transferred, as an "e" event
+// whose data is the JSON encoding of typ and fields. Players skip these
+// events. Raw recordings have no room for them, so they are dropped.
+func (r *Recorder) WriteEvent(typ string, fields map[string]interface{}) {
+	if r.raw {
+		return
+	}
+	data, err := json.Marshal(struct {
+		Type   string                 `json:"type"`
+		Fields map[string]interface{} `json:"fields,omitempty"`
+	}{typ, fields})
+	if err != nil {
+		return
+	}
+	r.log("e", data)
+}
+
+// Close closes the output of the recorder, if it can be closed.
+func (r *Recorder) Close() error {
+	if c, ok := r.output.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
@@ -1,6 +1,9 @@
 package auth
 
 import (
+	"context"
+	"time"
+
 	"github.com/gliderlabs/ssh"
 	"github.com/pkg/errors"
 )
@@ -13,14 +16,45 @@ type PasswordAuth interface {
 	Auth(ctx ssh.Context, password string) bool
 }
 
+// Reloader is implemented by the authentication methods which can read their
+// configuration again. Reload keeps the previous configuration if the new one
+// can't be read.
+type Reloader interface {
+	Reload() error
+}
+
+// Watcher is implemented by the authentication methods which can reload their
+// configuration when it changes. Watch checks it every interval until ctx is
+// done.
+type Watcher interface {
+	Watch(ctx context.Context, interval time.Duration)
+}
+
 type User struct {
 	Name  string
 	UID   uint32
 	GID   uint32
 	Home  string
 	Shell string
+
+	// Groups are the ids of all the groups of the user, including the primary
+	// one.
+	Groups []uint32
+}
+
+// GroupIDs returns the groups of the user, which is only the primary group if
+// Groups isn't set.
+func (u *User) GroupIDs() []uint32 {
+	if len(u.Groups) == 0 {
+		return []uint32{u.GID}
+	}
+	return u.Groups
 }
 
+// RunAs calls fn with the filesystem credentials of u, so that the files it
+// opens are subject to the permissions of u rather than those of the server.
+type RunAs func(u *User, fn func() error) error
+
 type UserStore interface {
 	Get(name string) (*User, error)
 }
@@ -0,0 +1,94 @@
+package auth
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/gliderlabs/ssh"
+	"golang.org/x/crypto/ed25519"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+func TestMain(m *testing.M) {
+	logrus.SetOutput(ioutil.Discard)
+	os.Exit(m.Run())
+}
+
+// testKey returns the ed25519 key generated from seed, so that the fixtures of
+// testdata can refer to the same keys.
+func testKey(t *testing.T, seed byte) gossh.Signer {
+	t.Helper()
+	_, priv, err := ed25519.GenerateKey(bytes.NewReader(bytes.Repeat([]byte{seed}, 32)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := gossh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer
+}
+
+// authorizedKey returns key as a line of an authorized keys file.
+func authorizedKey(key gossh.PublicKey) string {
+	return string(bytes.TrimSpace(gossh.MarshalAuthorizedKey(key)))
+}
+
+// testCert returns a user certificate of key for alice, valid forever and
+// permitting everything, signed by ca once modify has changed it.
+func testCert(t *testing.T, ca gossh.Signer, key gossh.PublicKey, modify func(c *gossh.Certificate)) *gossh.Certificate {
+	t.Helper()
+	cert := &gossh.Certificate{
+		Key:             key,
+		CertType:        gossh.UserCert,
+		KeyId:           "test",
+		ValidPrincipals: []string{"alice"},
+		ValidBefore:     gossh.CertTimeInfinity,
+		Permissions: gossh.Permissions{
+			Extensions: map[string]string{
+				"permit-pty":              "",
+				"permit-port-forwarding":  "",
+				"permit-agent-forwarding": "",
+				"permit-X11-forwarding":   "",
+			},
+		},
+	}
+	if modify != nil {
+		modify(cert)
+	}
+	if err := cert.SignCert(rand.Reader, ca); err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+// testContext is the context of a connection of user from addr.
+type testContext struct {
+	context.Context
+	user string
+	addr net.Addr
+}
+
+func newTestContext(t *testing.T, user, addr string) *testContext {
+	t.Helper()
+	a, err := net.ResolveTCPAddr("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testContext{Context: context.Background(), user: user, addr: a}
+}
+
+func (c *testContext) User() string                    { return c.user }
+func (c *testContext) SessionID() string               { return "test" }
+func (c *testContext) ClientVersion() string           { return "" }
+func (c *testContext) ServerVersion() string           { return "" }
+func (c *testContext) RemoteAddr() net.Addr            { return c.addr }
+func (c *testContext) LocalAddr() net.Addr             { return nil }
+func (c *testContext) Permissions() *ssh.Permissions   { return nil }
+func (c *testContext) SetValue(key, value interface{}) {}
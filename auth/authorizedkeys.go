@@ -0,0 +1,180 @@
+package auth
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/gliderlabs/ssh"
+	"github.com/pkg/errors"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// maxLineLength is the longest line of an authorized keys file, as in
+// OpenSSH.
+const maxLineLength = 16 * 1024
+
+const (
+	markerCertAuthority = "@cert-authority"
+	markerRevoked       = "@revoked"
+)
+
+// authorizedKeys are the keys of an authorized keys file.
+type authorizedKeys struct {
+	// keys are the lines of each key, by marshaled key.
+	keys map[string][]*AuthorizedKey
+
+	// revoked are the keys marked @revoked, which are refused whatever the
+	// other lines say.
+	revoked map[string]bool
+}
+
+func newAuthorizedKeys() *authorizedKeys {
+	return &authorizedKeys{
+		keys:    make(map[string][]*AuthorizedKey),
+		revoked: make(map[string]bool),
+	}
+}
+
+// add adds a line of key with opts.
+func (ak *authorizedKeys) add(key ssh.PublicKey, opts *KeyOptions) {
+	k := string(key.Marshal())
+	ak.keys[k] = append(ak.keys[k], &AuthorizedKey{Key: key, Options: opts})
+}
+
+// readLine reads the next line of r, without its end. Lines longer than
+// maxLineLength are read to their end but not returned, and long is set.
+func readLine(r *bufio.Reader) (line []byte, long bool, err error) {
+	for {
+		part, isPrefix, err := r.ReadLine()
+		if err != nil {
+			if err == io.EOF && (len(line) > 0 || long) {
+				return line, long, nil
+			}
+			return nil, false, err
+		}
+		if !long && len(line)+len(part) > maxLineLength {
+			line, long = nil, true
+		}
+		if !long {
+			line = append(line, part...)
+		}
+		if !isPrefix {
+			return line, long, nil
+		}
+	}
+}
+
+// parseAuthorizedKeys parses an authorized keys file. Blank lines and comments
+// are skipped, and so are the lines which can't be parsed or are too long,
+// with a warning giving their line number, so that one bad line doesn't lock
+// everyone out. Like in known_hosts files, keys may be marked @cert-authority
+// or @revoked.
+func parseAuthorizedKeys(r io.Reader, l *logrus.Entry) (*authorizedKeys, error) {
+	ak := newAuthorizedKeys()
+
+	var loaded, revoked, ignored int
+	reader := bufio.NewReader(r)
+	for n := 1; ; n++ {
+		line, long, err := readLine(reader)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, errors.Wrap(err, "read authorized keys")
+		}
+		ll := l.WithField("line", n)
+		if long {
+			ll.Warnf("Ignoring line longer than %d bytes", maxLineLength)
+			ignored++
+			continue
+		}
+
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+
+		var marker string
+		if line[0] == '@' {
+			i := bytes.IndexAny(line, " \t")
+			if i < 0 {
+				i = len(line)
+			}
+			marker, line = string(line[:i]), bytes.TrimSpace(line[i:])
+			if marker != markerCertAuthority && marker != markerRevoked {
+				ll.WithField("marker", marker).Warnln("Ignoring key with unknown marker")
+				ignored++
+				continue
+			}
+		}
+
+		pk, _, options, _, err := ssh.ParseAuthorizedKey(line)
+		if err != nil {
+			ll.WithError(err).Warnln("Ignoring invalid key")
+			ignored++
+			continue
+		}
+		if marker == markerRevoked {
+			ak.revoked[string(pk.Marshal())] = true
+			revoked++
+			continue
+		}
+
+		opts, err := ParseKeyOptions(options)
+		if err != nil {
+			ll.WithError(err).Warnln("Ignoring key with invalid options")
+			ignored++
+			continue
+		}
+		if marker == markerCertAuthority {
+			opts.CertAuthority = true
+		}
+
+		ak.add(pk, opts)
+		loaded++
+	}
+	l.WithFields(logrus.Fields{
+		"keys":    loaded,
+		"revoked": revoked,
+		"ignored": ignored,
+	}).Infoln("Loaded authorized keys")
+	return ak, nil
+}
+
+// isRevoked reports whether key is marked @revoked. Certificates are revoked
+// along with their key and the key which signed them.
+func (ak *authorizedKeys) isRevoked(key ssh.PublicKey) bool {
+	if cert, ok := key.(*gossh.Certificate); ok {
+		if ak.revoked[string(cert.Key.Marshal())] || ak.revoked[string(cert.SignatureKey.Marshal())] {
+			return true
+		}
+	}
+	return ak.revoked[string(key.Marshal())]
+}
+
+// accepted returns the options of the first line of key which ctx may use, as
+// OpenSSH uses the first line of a key whose restrictions it passes.
+// Certificates are accepted with the lines marked cert-authority of the key
+// which signed them.
+func (ak *authorizedKeys) accepted(ctx ssh.Context, key ssh.PublicKey) (*KeyOptions, bool) {
+	if ak.isRevoked(key) {
+		return nil, false
+	}
+	if cert, ok := key.(*gossh.Certificate); ok {
+		return ak.acceptedCert(ctx, cert, true)
+	}
+
+	for _, k := range ak.keys[string(key.Marshal())] {
+		if !ssh.KeysEqual(k.Key, key) || k.Options.CertAuthority {
+			continue
+		}
+		if k.Options.Expired(time.Now()) || !k.Options.FromAllowed(ctx.RemoteAddr()) {
+			continue
+		}
+		return k.Options, true
+	}
+	return nil, false
+}
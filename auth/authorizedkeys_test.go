@@ -0,0 +1,109 @@
+package auth
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/Sirupsen/logrus"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+func TestParseAuthorizedKeys(t *testing.T) {
+	plain, ca, revoked := testKey(t, 1), testKey(t, 2), testKey(t, 3)
+	unknownMarker, badOptions, afterLong := testKey(t, 4), testKey(t, 5), testKey(t, 6)
+
+	file := strings.Join([]string{
+		"# comment",
+		"",
+		`command="ls",no-pty ` + authorizedKey(plain.PublicKey()),
+		`@cert-authority principals="admin" ` + authorizedKey(ca.PublicKey()),
+		"@revoked " + authorizedKey(revoked.PublicKey()),
+		"@unknown " + authorizedKey(unknownMarker.PublicKey()),
+		"not a key",
+		"unknown-option " + authorizedKey(badOptions.PublicKey()),
+		authorizedKey(plain.PublicKey()) + " " + strings.Repeat("x", maxLineLength),
+		authorizedKey(afterLong.PublicKey()),
+	}, "\n")
+
+	ak, err := parseAuthorizedKeys(strings.NewReader(file), logrus.NewEntry(logrus.StandardLogger()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name          string
+		key           gossh.PublicKey
+		lines         int
+		certAuthority bool
+		revoked       bool
+	}{
+		{name: "plain key", key: plain.PublicKey(), lines: 1},
+		{name: "cert-authority marker", key: ca.PublicKey(), lines: 1, certAuthority: true},
+		{name: "revoked marker", key: revoked.PublicKey(), revoked: true},
+		{name: "unknown marker", key: unknownMarker.PublicKey()},
+		{name: "invalid options", key: badOptions.PublicKey()},
+		{name: "line after a too long one", key: afterLong.PublicKey(), lines: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lines := ak.keys[string(tt.key.Marshal())]
+			if len(lines) != tt.lines {
+				t.Fatalf("got %d lines, want %d", len(lines), tt.lines)
+			}
+			for _, k := range lines {
+				if k.Options.CertAuthority != tt.certAuthority {
+					t.Errorf("got cert-authority %v, want %v", k.Options.CertAuthority, tt.certAuthority)
+				}
+			}
+			if got := ak.isRevoked(tt.key); got != tt.revoked {
+				t.Errorf("got revoked %v, want %v", got, tt.revoked)
+			}
+		})
+	}
+
+	opts := ak.keys[string(plain.PublicKey().Marshal())][0].Options
+	if opts.Command != "ls" || !opts.NoPty {
+		t.Errorf("got options %+v, want the command ls without pty", opts)
+	}
+	caOpts := ak.keys[string(ca.PublicKey().Marshal())][0].Options
+	if len(caOpts.Principals) != 1 || caOpts.Principals[0] != "admin" {
+		t.Errorf("got principals %q, want admin", caOpts.Principals)
+	}
+}
+
+func TestAuthorizedKeysAccepted(t *testing.T) {
+	plain, ca, revoked, other := testKey(t, 1), testKey(t, 2), testKey(t, 3), testKey(t, 4)
+
+	file := strings.Join([]string{
+		authorizedKey(plain.PublicKey()),
+		"@cert-authority " + authorizedKey(ca.PublicKey()),
+		"@revoked " + authorizedKey(revoked.PublicKey()),
+		authorizedKey(revoked.PublicKey()),
+	}, "\n")
+	ak, err := parseAuthorizedKeys(strings.NewReader(file), logrus.NewEntry(logrus.StandardLogger()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		key      gossh.PublicKey
+		accepted bool
+	}{
+		{"plain key", plain.PublicKey(), true},
+		{"unknown key", other.PublicKey(), false},
+		{"revoked key listed again", revoked.PublicKey(), false},
+		{"authority key used as a plain key", ca.PublicKey(), false},
+		{"certificate of the authority", testCert(t, ca, other.PublicKey(), nil), true},
+		{"certificate of a plain key", testCert(t, plain, other.PublicKey(), nil), false},
+		{"certificate of a revoked key", testCert(t, ca, revoked.PublicKey(), nil), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := newTestContext(t, "alice", "127.0.0.1:2222")
+			if _, ok := ak.accepted(ctx, tt.key); ok != tt.accepted {
+				t.Errorf("got accepted %v, want %v", ok, tt.accepted)
+			}
+		})
+	}
+}
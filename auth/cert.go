@@ -0,0 +1,198 @@
+package auth
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/gliderlabs/ssh"
+	"github.com/pkg/errors"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+const (
+	optionForceCommand  = "force-command"
+	optionSourceAddress = "source-address"
+)
+
+// CertPublicKeyAuth authenticates users with OpenSSH certificates signed by
+// trusted certificate authorities, like OpenSSH's TrustedUserCAKeys. The
+// certificates must name the user as one of their principals.
+type CertPublicKeyAuth struct {
+	// file has the keys of the authorities when they are read from a file,
+	// and keys when they are given.
+	file *LocalPublickKeyAuth
+	keys *authorizedKeys
+}
+
+// NewCertPublicKeyAuth returns an authenticator trusting the authorities whose
+// keys are in file, in the format of authorized keys files.
+func NewCertPublicKeyAuth(file string) (*CertPublicKeyAuth, error) {
+	f, err := NewLocalPublicKeyAuth(file)
+	if err != nil {
+		return nil, err
+	}
+	return &CertPublicKeyAuth{file: f}, nil
+}
+
+// NewCertPublicKeyAuthKeys returns an authenticator trusting the authorities
+// of keys.
+func NewCertPublicKeyAuthKeys(keys ...ssh.PublicKey) *CertPublicKeyAuth {
+	ak := newAuthorizedKeys()
+	for _, k := range keys {
+		ak.add(k, &KeyOptions{CertAuthority: true})
+	}
+	return &CertPublicKeyAuth{keys: ak}
+}
+
+// authorities returns the keys of the trusted authorities.
+func (a *CertPublicKeyAuth) authorities() *authorizedKeys {
+	if a.file != nil {
+		return a.file.loaded()
+	}
+	return a.keys
+}
+
+// Reload reads the file of the authorities again, if there is one.
+func (a *CertPublicKeyAuth) Reload() error {
+	if a.file == nil {
+		return nil
+	}
+	return a.file.Reload()
+}
+
+// Watch reloads the file of the authorities whenever it changes, if there is
+// one.
+func (a *CertPublicKeyAuth) Watch(ctx context.Context, interval time.Duration) {
+	if a.file != nil {
+		a.file.Watch(ctx, interval)
+	}
+}
+
+func (a *CertPublicKeyAuth) Auth(ctx ssh.Context, key ssh.PublicKey) bool {
+	_, ok := a.AuthOptions(ctx, key)
+	return ok
+}
+
+// AuthOptions returns the restrictions of the certificate key, if it is signed
+// by a trusted authority and valid for ctx.
+func (a *CertPublicKeyAuth) AuthOptions(ctx ssh.Context, key ssh.PublicKey) (*KeyOptions, bool) {
+	cert, ok := key.(*gossh.Certificate)
+	if !ok {
+		return nil, false
+	}
+	l := certLogger(ctx, cert)
+
+	ak := a.authorities()
+	if ak.isRevoked(key) {
+		l.Warnln("Refused revoked key")
+		return nil, false
+	}
+	if len(ak.keys[string(cert.SignatureKey.Marshal())]) == 0 {
+		l.Warnln("Refused certificate of an untrusted authority")
+		return nil, false
+	}
+
+	return ak.acceptedCert(ctx, cert, false)
+}
+
+// certLogger returns the logger of the authentication of ctx with cert.
+func certLogger(ctx ssh.Context, cert *gossh.Certificate) *logrus.Entry {
+	return logrus.WithFields(logrus.Fields{
+		"user":       ctx.User(),
+		"session_id": ctx.SessionID(),
+		"key_id":     cert.KeyId,
+		"serial":     cert.Serial,
+	})
+}
+
+// acceptedCert returns the options under which ctx may use cert, with the
+// first line of the key which signed it whose restrictions it passes. If
+// marked is set, only the lines marked cert-authority trust the key.
+func (ak *authorizedKeys) acceptedCert(ctx ssh.Context, cert *gossh.Certificate, marked bool) (*KeyOptions, bool) {
+	l := certLogger(ctx, cert)
+
+	for _, k := range ak.keys[string(cert.SignatureKey.Marshal())] {
+		if marked && !k.Options.CertAuthority {
+			continue
+		}
+		if k.Options.Expired(time.Now()) || !k.Options.FromAllowed(ctx.RemoteAddr()) {
+			continue
+		}
+
+		opts, err := checkCert(ctx, cert, k.Options)
+		if err != nil {
+			l.WithError(err).Warnln("Refused certificate")
+			continue
+		}
+		l.Infoln("Accepted certificate")
+		return opts, true
+	}
+	return nil, false
+}
+
+// checkCert checks cert may be used by ctx, trusted by an authority key with
+// the options ca, and returns the options of the key restricted by those of
+// the certificate. Like OpenSSH, the certificate must have one of the
+// principals of the options, or the name of the user without any.
+func checkCert(ctx ssh.Context, cert *gossh.Certificate, ca *KeyOptions) (*KeyOptions, error) {
+	if cert.CertType != gossh.UserCert {
+		return nil, errors.Errorf("certificate of type %d is not a user certificate", cert.CertType)
+	}
+	if len(cert.ValidPrincipals) == 0 {
+		return nil, errors.New("certificate has no principals")
+	}
+
+	names := ca.Principals
+	if len(names) == 0 {
+		names = []string{ctx.User()}
+	}
+	var principal string
+	for _, p := range cert.ValidPrincipals {
+		for _, name := range names {
+			if p == name && principal == "" {
+				principal = p
+			}
+		}
+	}
+	if principal == "" {
+		return nil, errors.Errorf("no principal of %q is allowed", cert.ValidPrincipals)
+	}
+
+	// The checker checks the validity window and the signature, and refuses
+	// the critical options it doesn't know.
+	checker := &gossh.CertChecker{SupportedCriticalOptions: []string{optionForceCommand}}
+	if err := checker.CheckCert(principal, cert); err != nil {
+		return nil, err
+	}
+
+	if src, ok := cert.CriticalOptions[optionSourceAddress]; ok {
+		from := &KeyOptions{From: strings.Split(src, ",")}
+		if !from.FromAllowed(ctx.RemoteAddr()) {
+			return nil, errors.Errorf("connection from %s is not allowed by source-address", ctx.RemoteAddr())
+		}
+	}
+
+	opts := *ca
+	opts.CertAuthority = false
+
+	if cmd, ok := cert.CriticalOptions[optionForceCommand]; ok {
+		if opts.Command != "" && opts.Command != cmd {
+			return nil, errors.New("certificate and key force different commands")
+		}
+		opts.Command = cmd
+	}
+
+	// Certificates grant the permissions they list as extensions.
+	permitted := func(ext string) bool {
+		_, ok := cert.Extensions[ext]
+		return ok
+	}
+	opts.NoPty = opts.NoPty || !permitted("permit-pty")
+	opts.NoPortForwarding = opts.NoPortForwarding || !permitted("permit-port-forwarding")
+	opts.NoAgentForwarding = opts.NoAgentForwarding || !permitted("permit-agent-forwarding")
+	opts.NoX11Forwarding = opts.NoX11Forwarding || !permitted("permit-X11-forwarding")
+
+	return &opts, nil
+}
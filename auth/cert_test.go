@@ -0,0 +1,178 @@
+package auth
+
+import (
+	"testing"
+	"time"
+
+	gossh "golang.org/x/crypto/ssh"
+)
+
+func TestCheckCert(t *testing.T) {
+	ca, key := testKey(t, 1), testKey(t, 2)
+
+	tests := []struct {
+		name   string
+		modify func(c *gossh.Certificate)
+		ca     KeyOptions
+		user   string
+		addr   string
+		ok     bool
+		check  func(t *testing.T, opts *KeyOptions)
+	}{
+		{
+			name: "valid",
+			ok:   true,
+			check: func(t *testing.T, opts *KeyOptions) {
+				if opts.NoPty || opts.NoPortForwarding || opts.NoAgentForwarding || opts.NoX11Forwarding {
+					t.Errorf("got restrictions %+v, want none", opts)
+				}
+			},
+		},
+		{
+			name:   "host certificate",
+			modify: func(c *gossh.Certificate) { c.CertType = gossh.HostCert },
+		},
+		{
+			name:   "no principals",
+			modify: func(c *gossh.Certificate) { c.ValidPrincipals = nil },
+		},
+		{
+			name: "principal of another user",
+			user: "bob",
+		},
+		{
+			name:   "principal allowed by the authority",
+			modify: func(c *gossh.Certificate) { c.ValidPrincipals = []string{"admin"} },
+			ca:     KeyOptions{Principals: []string{"admin"}},
+			ok:     true,
+		},
+		{
+			name: "principal of the user not allowed by the authority",
+			ca:   KeyOptions{Principals: []string{"admin"}},
+		},
+		{
+			name:   "expired",
+			modify: func(c *gossh.Certificate) { c.ValidBefore = uint64(time.Now().Add(-time.Hour).Unix()) },
+		},
+		{
+			name:   "not yet valid",
+			modify: func(c *gossh.Certificate) { c.ValidAfter = uint64(time.Now().Add(time.Hour).Unix()) },
+		},
+		{
+			name: "unknown critical option",
+			modify: func(c *gossh.Certificate) {
+				c.CriticalOptions = map[string]string{"verify-required": ""}
+			},
+		},
+		{
+			name: "forced command",
+			modify: func(c *gossh.Certificate) {
+				c.CriticalOptions = map[string]string{optionForceCommand: "uptime"}
+			},
+			ok: true,
+			check: func(t *testing.T, opts *KeyOptions) {
+				if opts.Command != "uptime" {
+					t.Errorf("got command %q, want uptime", opts.Command)
+				}
+			},
+		},
+		{
+			name: "forced command differing from the authority's",
+			modify: func(c *gossh.Certificate) {
+				c.CriticalOptions = map[string]string{optionForceCommand: "uptime"}
+			},
+			ca: KeyOptions{Command: "ls"},
+		},
+		{
+			name: "source address allowed",
+			modify: func(c *gossh.Certificate) {
+				c.CriticalOptions = map[string]string{optionSourceAddress: "10.0.0.0/8,127.0.0.1"}
+			},
+			ok: true,
+		},
+		{
+			name: "source address refused",
+			modify: func(c *gossh.Certificate) {
+				c.CriticalOptions = map[string]string{optionSourceAddress: "10.0.0.0/8"}
+			},
+		},
+		{
+			name:   "no extensions",
+			modify: func(c *gossh.Certificate) { c.Extensions = nil },
+			ok:     true,
+			check: func(t *testing.T, opts *KeyOptions) {
+				if !opts.NoPty || !opts.NoPortForwarding || !opts.NoAgentForwarding || !opts.NoX11Forwarding {
+					t.Errorf("got restrictions %+v, want all of them", opts)
+				}
+			},
+		},
+		{
+			name: "restrictions of the authority kept",
+			ca:   KeyOptions{NoPty: true},
+			ok:   true,
+			check: func(t *testing.T, opts *KeyOptions) {
+				if !opts.NoPty {
+					t.Error("got a pty, want none")
+				}
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			user, addr := tt.user, tt.addr
+			if user == "" {
+				user = "alice"
+			}
+			if addr == "" {
+				addr = "127.0.0.1:2222"
+			}
+
+			cert := testCert(t, ca, key.PublicKey(), tt.modify)
+			caOpts := tt.ca
+			caOpts.CertAuthority = true
+			opts, err := checkCert(newTestContext(t, user, addr), cert, &caOpts)
+			if (err == nil) != tt.ok {
+				t.Fatalf("got error %v, want ok %v", err, tt.ok)
+			}
+			if err == nil && opts.CertAuthority {
+				t.Error("got cert-authority options for the certificate")
+			}
+			if err == nil && tt.check != nil {
+				tt.check(t, opts)
+			}
+		})
+	}
+}
+
+func TestCheckCertSignature(t *testing.T) {
+	ca, key := testKey(t, 1), testKey(t, 2)
+
+	cert := testCert(t, ca, key.PublicKey(), nil)
+	cert.Serial++
+	if _, err := checkCert(newTestContext(t, "alice", "127.0.0.1:2222"), cert, &KeyOptions{CertAuthority: true}); err == nil {
+		t.Error("accepted a certificate with a bad signature")
+	}
+}
+
+func TestCertPublicKeyAuth(t *testing.T) {
+	ca, other, key := testKey(t, 1), testKey(t, 2), testKey(t, 3)
+	a := NewCertPublicKeyAuthKeys(ca.PublicKey())
+
+	tests := []struct {
+		name string
+		key  gossh.PublicKey
+		ok   bool
+	}{
+		{"certificate of the authority", testCert(t, ca, key.PublicKey(), nil), true},
+		{"certificate of another authority", testCert(t, other, key.PublicKey(), nil), false},
+		{"plain key", key.PublicKey(), false},
+		{"authority key", ca.PublicKey(), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if ok := a.Auth(newTestContext(t, "alice", "127.0.0.1:2222"), tt.key); ok != tt.ok {
+				t.Errorf("got %v, want %v", ok, tt.ok)
+			}
+		})
+	}
+}
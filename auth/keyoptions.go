@@ -0,0 +1,245 @@
+package auth
+
+import (
+	"net"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gliderlabs/ssh"
+	"github.com/pkg/errors"
+)
+
+// KeyOptions are the options of a key in an authorized keys file, as
+// described in sshd(8).
+type KeyOptions struct {
+	// Command is run instead of the command of the client.
+	Command string
+
+	// From are patterns of the addresses the client may connect from,
+	// which can be negated with ! and be networks like 10.0.0.0/8.
+	From []string
+
+	NoPty             bool
+	NoPortForwarding  bool
+	NoAgentForwarding bool
+	NoX11Forwarding   bool
+
+	// Environment are variables like NAME=value set in sessions.
+	Environment []string
+
+	// ExpiryTime is when the key stops being accepted, if set.
+	ExpiryTime time.Time
+
+	// PermitOpen and PermitListen are the host:port local and remote
+	// forwarding is restricted to, if set. The port may be *.
+	PermitOpen   []string
+	PermitListen []string
+
+	// Principals are the names certificates signed by a certificate
+	// authority key must have one of.
+	Principals []string
+
+	CertAuthority bool
+}
+
+// AuthorizedKey is a key of an authorized keys file, with its options.
+type AuthorizedKey struct {
+	Key     ssh.PublicKey
+	Options *KeyOptions
+}
+
+// KeyOptionsAuth is implemented by the public key authenticators whose keys
+// have options. AuthOptions returns the options of key if it is accepted.
+type KeyOptionsAuth interface {
+	AuthOptions(ctx ssh.Context, key ssh.PublicKey) (*KeyOptions, bool)
+}
+
+// optionValue returns the value of an option like name="value", without the
+// quotes.
+func optionValue(opt string) (string, string, bool) {
+	parts := strings.SplitN(opt, "=", 2)
+	name := strings.ToLower(parts[0])
+	if len(parts) == 1 {
+		return name, "", false
+	}
+
+	v := parts[1]
+	if len(v) >= 2 && v[0] == '"' && v[len(v)-1] == '"' {
+		v = strings.Replace(v[1:len(v)-1], `\"`, `"`, -1)
+	}
+	return name, v, true
+}
+
+// parseExpiryTime parses times like YYYYMMDD[HHMM[SS]], in local time unless
+// they end with Z.
+func parseExpiryTime(s string) (time.Time, error) {
+	loc := time.Local
+	if strings.HasSuffix(s, "Z") || strings.HasSuffix(s, "z") {
+		s, loc = s[:len(s)-1], time.UTC
+	}
+
+	layouts := map[int]string{
+		8:  "20060102",
+		12: "200601021504",
+		14: "20060102150405",
+	}
+	layout, ok := layouts[len(s)]
+	if !ok {
+		return time.Time{}, errors.Errorf("invalid expiry time %q", s)
+	}
+	return time.ParseInLocation(layout, s, loc)
+}
+
+// ParseKeyOptions parses the options of a key, as returned by
+// ssh.ParseAuthorizedKey. Unknown options are errors, as the key would be
+// accepted with fewer restrictions than intended.
+func ParseKeyOptions(options []string) (*KeyOptions, error) {
+	o := &KeyOptions{}
+
+	for _, opt := range options {
+		name, value, hasValue := optionValue(opt)
+
+		switch name {
+		case "restrict":
+			o.NoPty = true
+			o.NoPortForwarding = true
+			o.NoAgentForwarding = true
+			o.NoX11Forwarding = true
+		case "no-pty":
+			o.NoPty = true
+		case "pty":
+			o.NoPty = false
+		case "no-port-forwarding":
+			o.NoPortForwarding = true
+		case "port-forwarding":
+			o.NoPortForwarding = false
+		case "no-agent-forwarding":
+			o.NoAgentForwarding = true
+		case "agent-forwarding":
+			o.NoAgentForwarding = false
+		case "no-x11-forwarding":
+			o.NoX11Forwarding = true
+		case "x11-forwarding":
+			o.NoX11Forwarding = false
+		case "cert-authority":
+			o.CertAuthority = true
+		case "no-user-rc", "user-rc":
+			// Users' rc files are never run.
+		default:
+			if !hasValue {
+				return nil, errors.Errorf("unsupported option %q", opt)
+			}
+
+			var err error
+			switch name {
+			case "command":
+				o.Command = value
+			case "from":
+				o.From = append(o.From, strings.Split(value, ",")...)
+			case "environment":
+				if !strings.Contains(value, "=") {
+					return nil, errors.Errorf("invalid environment %q", value)
+				}
+				o.Environment = append(o.Environment, value)
+			case "expiry-time":
+				o.ExpiryTime, err = parseExpiryTime(value)
+			case "permitopen":
+				_, _, err = net.SplitHostPort(value)
+				o.PermitOpen = append(o.PermitOpen, value)
+			case "permitlisten":
+				// Without a host, the policy of the server decides
+				// which addresses may be bound.
+				if !strings.Contains(value, ":") {
+					value = "*:" + value
+				}
+				_, _, err = net.SplitHostPort(value)
+				o.PermitListen = append(o.PermitListen, value)
+			case "principals":
+				o.Principals = append(o.Principals, strings.Split(value, ",")...)
+			case "tunnel":
+				// Tunnels are never allowed.
+			default:
+				return nil, errors.Errorf("unsupported option %q", opt)
+			}
+			if err != nil {
+				return nil, errors.Wrapf(err, "invalid option %q", opt)
+			}
+		}
+	}
+
+	return o, nil
+}
+
+// FromAllowed reports whether a client at addr may use the key. Like
+// OpenSSH, a negated pattern matching the address refuses it.
+func (o *KeyOptions) FromAllowed(addr net.Addr) bool {
+	if len(o.From) == 0 {
+		return true
+	}
+
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+
+	allowed := false
+	for _, p := range o.From {
+		negated := strings.HasPrefix(p, "!")
+		p = strings.TrimPrefix(p, "!")
+
+		var match bool
+		if strings.Contains(p, "/") {
+			_, network, err := net.ParseCIDR(p)
+			match = err == nil && ip != nil && network.Contains(ip)
+		} else {
+			match, _ = path.Match(strings.ToLower(p), strings.ToLower(host))
+		}
+
+		if match && negated {
+			return false
+		}
+		allowed = allowed || match
+	}
+	return allowed
+}
+
+// Expired reports whether the key isn't accepted anymore at now.
+func (o *KeyOptions) Expired(now time.Time) bool {
+	return !o.ExpiryTime.IsZero() && now.After(o.ExpiryTime)
+}
+
+// allowedHostPort reports whether host and port match one of permitted.
+func allowedHostPort(permitted []string, host string, port uint32) bool {
+	for _, p := range permitted {
+		h, ps, err := net.SplitHostPort(p)
+		if err != nil {
+			continue
+		}
+		if h != "*" && !strings.EqualFold(h, host) {
+			continue
+		}
+		if ps == "*" || ps == strconv.FormatUint(uint64(port), 10) {
+			return true
+		}
+	}
+	return false
+}
+
+// OpenAllowed reports whether local forwarding may connect to port of host.
+func (o *KeyOptions) OpenAllowed(host string, port uint32) bool {
+	if o.NoPortForwarding {
+		return false
+	}
+	return len(o.PermitOpen) == 0 || allowedHostPort(o.PermitOpen, host, port)
+}
+
+// ListenAllowed reports whether remote forwarding may listen on port of host.
+func (o *KeyOptions) ListenAllowed(host string, port uint32) bool {
+	if o.NoPortForwarding {
+		return false
+	}
+	return len(o.PermitListen) == 0 || allowedHostPort(o.PermitListen, host, port)
+}
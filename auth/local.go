@@ -2,52 +2,136 @@ package auth
 
 import (
 	"bufio"
+	"context"
 	"os"
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 
+	"github.com/Sirupsen/logrus"
 	"github.com/gliderlabs/ssh"
 	"github.com/pkg/errors"
 )
 
 type LocalPublickKeyAuth struct {
 	sync.RWMutex
-	keys map[string]ssh.PublicKey
+	file string
+	keys *authorizedKeys
+
+	// info is the file the keys were last loaded from, or failed to be.
+	info os.FileInfo
 }
 
 func NewLocalPublicKeyAuth(file string) (*LocalPublickKeyAuth, error) {
-	s := &LocalPublickKeyAuth{
-		keys: make(map[string]ssh.PublicKey),
+	s := &LocalPublickKeyAuth{file: file}
+	if err := s.Reload(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Reload reads the authorized keys file again. The keys are replaced at once,
+// and kept as they are if the file can't be read.
+func (s *LocalPublickKeyAuth) Reload() error {
+	info, err := os.Stat(s.file)
+	if err != nil {
+		return errors.Wrap(err, "open authorized key file")
+	}
+
+	s.Lock()
+	s.info = info
+	s.Unlock()
+
+	keys, err := readAuthorizedKeys(s.file)
+	if err != nil {
+		return err
 	}
 
+	s.Lock()
+	s.keys = keys
+	s.Unlock()
+	return nil
+}
+
+func readAuthorizedKeys(file string) (*authorizedKeys, error) {
 	f, err := os.Open(file)
 	if err != nil {
 		return nil, errors.Wrap(err, "open authorized key file")
 	}
+	defer f.Close()
 
-	scanner := bufio.NewScanner(f)
-	for scanner.Scan() {
-		pk, _, _, _, err := ssh.ParseAuthorizedKey(scanner.Bytes())
-		if err != nil {
-			return nil, errors.Wrap(err, "parse key")
+	return parseAuthorizedKeys(f, logrus.WithField("file", file))
+}
+
+// loaded returns the keys last loaded.
+func (s *LocalPublickKeyAuth) loaded() *authorizedKeys {
+	s.RLock()
+	defer s.RUnlock()
+
+	return s.keys
+}
+
+// changed reports whether the file described by info differs from the one
+// the keys were last loaded from. Replacing it counts as a change.
+func (s *LocalPublickKeyAuth) changed(info os.FileInfo) bool {
+	s.RLock()
+	defer s.RUnlock()
+
+	return s.info == nil ||
+		!os.SameFile(s.info, info) ||
+		!s.info.ModTime().Equal(info.ModTime()) ||
+		s.info.Size() != info.Size()
+}
+
+// Watch reloads the authorized keys file whenever it changes, checking every
+// interval until ctx is done. If the new file can't be read, the last keys
+// read are kept until it changes again.
+func (s *LocalPublickKeyAuth) Watch(ctx context.Context, interval time.Duration) {
+	l := logrus.WithField("file", s.file)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
 		}
-		s.keys[string(pk.Marshal())] = pk
-	}
 
-	return s, nil
+		info, err := os.Stat(s.file)
+		if err != nil || !s.changed(info) {
+			continue
+		}
+
+		if err := s.Reload(); err != nil {
+			l.WithError(err).Warnln("Failed to reload authorized keys, keeping the previous ones")
+			continue
+		}
+		l.Infoln("Reloaded authorized keys")
+	}
 }
 
 func (s *LocalPublickKeyAuth) Auth(ctx ssh.Context, key ssh.PublicKey) bool {
+	_, ok := s.AuthOptions(ctx, key)
+	return ok
+}
+
+// AuthOptions returns the options of the first line of key ctx may use.
+func (s *LocalPublickKeyAuth) AuthOptions(ctx ssh.Context, key ssh.PublicKey) (*KeyOptions, bool) {
 	s.RLock()
 	defer s.RUnlock()
 
-	k, ok := s.keys[string(key.Marshal())]
-	if !ok {
-		return false
+	if s.keys.isRevoked(key) {
+		logrus.WithFields(logrus.Fields{
+			"user":       ctx.User(),
+			"session_id": ctx.SessionID(),
+			"file":       s.file,
+		}).Warnln("Refused revoked key")
+		return nil, false
 	}
-
-	return ssh.KeysEqual(k, key)
+	return s.keys.accepted(ctx, key)
 }
 
 type LocalUserStore struct {
@@ -71,14 +155,54 @@ func (s *LocalUserStore) Get(name string) (*User, error) {
 		if parts[0] != name {
 			continue
 		}
-		return &User{
+		user := &User{
 			Name:  name,
 			UID:   mustUint32(parts[2]),
 			GID:   mustUint32(parts[3]),
 			Home:  parts[5],
 			Shell: parts[6],
-		}, nil
+		}
+
+		groups, err := groupsOf(name, user.GID)
+		if err != nil {
+			return nil, err
+		}
+		user.Groups = groups
+
+		return user, nil
 	}
 
 	return nil, errors.Errorf("user %s not found", name)
 }
+
+// groupsOf returns the primary group gid followed by the groups listing name
+// as a member in /etc/group, like initgroups(3).
+func groupsOf(name string, gid uint32) ([]uint32, error) {
+	f, err := os.Open("/etc/group")
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to open /etc/group")
+	}
+	defer f.Close()
+
+	groups := []uint32{gid}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		parts := strings.Split(scanner.Text(), ":")
+		if len(parts) != 4 {
+			continue
+		}
+
+		id := mustUint32(parts[2])
+		if id == gid {
+			continue
+		}
+		for _, member := range strings.Split(parts[3], ",") {
+			if member == name {
+				groups = append(groups, id)
+				break
+			}
+		}
+	}
+
+	return groups, errors.Wrap(scanner.Err(), "Failed to read /etc/group")
+}
@@ -0,0 +1,476 @@
+package auth
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/gliderlabs/ssh"
+	"github.com/pkg/errors"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// krlMagic starts the key revocation lists of OpenSSH.
+const krlMagic = "SSHKRL\n\x00"
+
+// The sections of key revocation lists, as described in PROTOCOL.krl of
+// OpenSSH.
+const (
+	krlSectionCertificates      = 1
+	krlSectionExplicitKey       = 2
+	krlSectionFingerprintSHA1   = 3
+	krlSectionSignature         = 4
+	krlSectionFingerprintSHA256 = 5
+
+	krlCertSerialList   = 0x20
+	krlCertSerialRange  = 0x21
+	krlCertSerialBitmap = 0x22
+	krlCertKeyID        = 0x23
+)
+
+// revocationList are the keys and certificates of a revocation list.
+type revocationList struct {
+	// keys are marshaled keys, and sha1 and sha256 their hashes.
+	keys   map[string]bool
+	sha1   map[string]bool
+	sha256 map[string]bool
+
+	certs []*revokedCerts
+}
+
+// revokedCerts are the certificates revoked for an authority.
+type revokedCerts struct {
+	// ca is the marshaled key of the authority, or empty for any.
+	ca      string
+	serials []serialRange
+	ids     map[string]bool
+}
+
+type serialRange struct {
+	min, max uint64
+}
+
+func newRevocationList() *revocationList {
+	return &revocationList{
+		keys:   make(map[string]bool),
+		sha1:   make(map[string]bool),
+		sha256: make(map[string]bool),
+	}
+}
+
+// keyRevoked reports whether key itself is revoked.
+func (rl *revocationList) keyRevoked(key gossh.PublicKey) bool {
+	b := key.Marshal()
+	h1, h256 := sha1.Sum(b), sha256.Sum256(b)
+	return rl.keys[string(b)] || rl.sha1[string(h1[:])] || rl.sha256[string(h256[:])]
+}
+
+// revoked reports whether key is revoked. Certificates are revoked along with
+// their key and the key which signed them.
+func (rl *revocationList) revoked(key gossh.PublicKey) bool {
+	if rl.keyRevoked(key) {
+		return true
+	}
+
+	cert, ok := key.(*gossh.Certificate)
+	if !ok {
+		return false
+	}
+	if rl.keyRevoked(cert.Key) || rl.keyRevoked(cert.SignatureKey) {
+		return true
+	}
+
+	ca := string(cert.SignatureKey.Marshal())
+	for _, rc := range rl.certs {
+		if rc.ca != "" && rc.ca != ca {
+			continue
+		}
+		if rc.ids[cert.KeyId] {
+			return true
+		}
+		for _, r := range rc.serials {
+			if cert.Serial >= r.min && cert.Serial <= r.max {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// krlReader reads the fields of a key revocation list, remembering the first
+// error.
+type krlReader struct {
+	b   []byte
+	err error
+}
+
+func (r *krlReader) next(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if len(r.b) < n {
+		r.err = errors.New("truncated key revocation list")
+		r.b = nil
+		return nil
+	}
+	b := r.b[:n]
+	r.b = r.b[n:]
+	return b
+}
+
+func (r *krlReader) more() bool {
+	return r.err == nil && len(r.b) > 0
+}
+
+func (r *krlReader) byte() byte {
+	if b := r.next(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (r *krlReader) uint32() uint32 {
+	if b := r.next(4); b != nil {
+		return binary.BigEndian.Uint32(b)
+	}
+	return 0
+}
+
+func (r *krlReader) uint64() uint64 {
+	if b := r.next(8); b != nil {
+		return binary.BigEndian.Uint64(b)
+	}
+	return 0
+}
+
+func (r *krlReader) string() []byte {
+	return r.next(int(r.uint32()))
+}
+
+// parseKRL parses a key revocation list of OpenSSH, made by ssh-keygen -k.
+func parseKRL(b []byte) (*revocationList, error) {
+	rl := newRevocationList()
+
+	r := &krlReader{b: b[len(krlMagic):]}
+	if v := r.uint32(); r.err == nil && v != 1 {
+		return nil, errors.Errorf("unsupported key revocation list version %d", v)
+	}
+	r.uint64() // version of the list
+	r.uint64() // date it was generated
+	r.uint64() // flags
+	r.string() // reserved
+	r.string() // comment
+
+	for r.more() {
+		typ := r.byte()
+		// Signatures come last, and aren't checked: the list is trusted
+		// like the rest of the configuration.
+		if typ == krlSectionSignature {
+			break
+		}
+
+		s := &krlReader{b: r.string()}
+		switch typ {
+		case krlSectionCertificates:
+			rc, err := parseKRLCerts(s)
+			if err != nil {
+				return nil, err
+			}
+			rl.certs = append(rl.certs, rc)
+		case krlSectionExplicitKey:
+			for s.more() {
+				rl.keys[string(s.string())] = true
+			}
+		case krlSectionFingerprintSHA1:
+			for s.more() {
+				rl.sha1[string(s.string())] = true
+			}
+		case krlSectionFingerprintSHA256:
+			for s.more() {
+				rl.sha256[string(s.string())] = true
+			}
+		default:
+			return nil, errors.Errorf("unknown key revocation list section %d", typ)
+		}
+		if s.err != nil {
+			return nil, s.err
+		}
+	}
+
+	return rl, r.err
+}
+
+// parseKRLCerts parses a certificates section of a key revocation list.
+func parseKRLCerts(s *krlReader) (*revokedCerts, error) {
+	rc := &revokedCerts{ids: make(map[string]bool)}
+	if ca := s.string(); len(ca) > 0 {
+		rc.ca = string(ca)
+	}
+	s.string() // reserved
+
+	for s.more() {
+		typ := s.byte()
+		d := &krlReader{b: s.string()}
+		switch typ {
+		case krlCertSerialList:
+			for d.more() {
+				n := d.uint64()
+				rc.serials = append(rc.serials, serialRange{n, n})
+			}
+		case krlCertSerialRange:
+			rc.serials = append(rc.serials, serialRange{d.uint64(), d.uint64()})
+		case krlCertSerialBitmap:
+			// Bit i of the bitmap revokes the serial offset+i.
+			offset := d.uint64()
+			bits := new(big.Int).SetBytes(d.string())
+			for i := 0; i < bits.BitLen(); i++ {
+				if bits.Bit(i) == 0 {
+					continue
+				}
+				n := offset + uint64(i)
+				if l := len(rc.serials); l > 0 && rc.serials[l-1].max == n-1 {
+					rc.serials[l-1].max = n
+				} else {
+					rc.serials = append(rc.serials, serialRange{n, n})
+				}
+			}
+		case krlCertKeyID:
+			for d.more() {
+				rc.ids[string(d.string())] = true
+			}
+		default:
+			return nil, errors.Errorf("unknown key revocation list certificate section %d", typ)
+		}
+		if d.err != nil {
+			return nil, d.err
+		}
+	}
+
+	return rc, s.err
+}
+
+// parseFingerprint parses a fingerprint as printed by ssh-keygen -l, like
+// SHA256:base64.
+func parseFingerprint(rl *revocationList, s string) error {
+	parts := strings.SplitN(s, ":", 2)
+	if len(parts) != 2 {
+		return errors.Errorf("invalid fingerprint %q", s)
+	}
+	h, err := base64.RawStdEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return errors.Wrapf(err, "invalid fingerprint %q", s)
+	}
+
+	switch {
+	case strings.EqualFold(parts[0], "SHA256") && len(h) == sha256.Size:
+		rl.sha256[string(h)] = true
+	case strings.EqualFold(parts[0], "SHA1") && len(h) == sha1.Size:
+		rl.sha1[string(h)] = true
+	default:
+		return errors.Errorf("invalid fingerprint %q", s)
+	}
+	return nil
+}
+
+// parseSerials parses a serial like 10, or a range of them like 10-20.
+func parseSerials(s string) (serialRange, error) {
+	parts := strings.SplitN(s, "-", 2)
+	min, err := strconv.ParseUint(strings.TrimSpace(parts[0]), 0, 64)
+	if err != nil {
+		return serialRange{}, errors.Errorf("invalid serial %q", s)
+	}
+	max := min
+	if len(parts) == 2 {
+		if max, err = strconv.ParseUint(strings.TrimSpace(parts[1]), 0, 64); err != nil || max < min {
+			return serialRange{}, errors.Errorf("invalid serial range %q", s)
+		}
+	}
+	return serialRange{min, max}, nil
+}
+
+// parseRevokedList parses a text list of revoked keys, with a key, a
+// fingerprint or the serials or key ID of revoked certificates on every line,
+// like the specifications ssh-keygen -k reads:
+//
+//	ssh-ed25519 AAAA... old laptop
+//	SHA256:4yT1yD8mmL2UkaxpuaPQMmk1j1YKoxqdWJP9MEHH1Tg
+//	serial: 1-100
+//	id: alice@laptop
+//
+// Serials and key IDs apply to the certificates of any authority. Unlike in
+// authorized keys files, a line which can't be parsed is an error, as it
+// could be a key meant to be revoked.
+func parseRevokedList(r io.Reader) (*revocationList, error) {
+	rl := newRevocationList()
+	certs := &revokedCerts{ids: make(map[string]bool)}
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, maxLineLength)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+
+		directive, value := "", line
+		if i := strings.Index(line, ":"); i > 0 && !strings.ContainsAny(line[:i], " \t") {
+			directive, value = strings.ToLower(line[:i]), strings.TrimSpace(line[i+1:])
+		}
+
+		var err error
+		switch directive {
+		case "serial":
+			var sr serialRange
+			if sr, err = parseSerials(value); err == nil {
+				certs.serials = append(certs.serials, sr)
+			}
+		case "id":
+			certs.ids[value] = true
+		case "hash":
+			err = parseFingerprint(rl, value)
+		case "sha1", "sha256":
+			// The line is a fingerprint like SHA256:base64, or the key
+			// whose hash is revoked.
+			if !strings.ContainsAny(value, " \t") {
+				err = parseFingerprint(rl, line)
+				break
+			}
+			fallthrough
+		case "", "key":
+			var pk ssh.PublicKey
+			if pk, _, _, _, err = ssh.ParseAuthorizedKey([]byte(value)); err == nil {
+				rl.keys[string(pk.Marshal())] = true
+			}
+		default:
+			err = errors.Errorf("unknown directive %q", directive)
+		}
+		if err != nil {
+			return nil, errors.Wrapf(err, "line %d", n)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, errors.Wrap(err, "read revoked keys")
+	}
+
+	if len(certs.serials) > 0 || len(certs.ids) > 0 {
+		rl.certs = append(rl.certs, certs)
+	}
+	return rl, nil
+}
+
+// RevokedKeys are keys and certificates refused whatever the authentication
+// methods say, like OpenSSH's RevokedKeys. They are read from a key revocation
+// list made by ssh-keygen -k, or from a text list of keys, fingerprints,
+// certificate serials and key IDs.
+type RevokedKeys struct {
+	sync.RWMutex
+	file string
+	list *revocationList
+
+	// info is the file the list was last loaded from, or failed to be.
+	info os.FileInfo
+}
+
+// NewRevokedKeys returns the keys revoked by file, which must exist.
+func NewRevokedKeys(file string) (*RevokedKeys, error) {
+	r := &RevokedKeys{file: file}
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Reload reads the revoked keys file again. The list is kept as it is if the
+// file can't be read.
+func (r *RevokedKeys) Reload() error {
+	info, err := os.Stat(r.file)
+	if err != nil {
+		return errors.Wrap(err, "open revoked keys file")
+	}
+
+	r.Lock()
+	r.info = info
+	r.Unlock()
+
+	b, err := ioutil.ReadFile(r.file)
+	if err != nil {
+		return errors.Wrap(err, "open revoked keys file")
+	}
+
+	var list *revocationList
+	if bytes.HasPrefix(b, []byte(krlMagic)) {
+		list, err = parseKRL(b)
+	} else {
+		list, err = parseRevokedList(bytes.NewReader(b))
+	}
+	if err != nil {
+		return errors.Wrapf(err, "parse revoked keys file %s", r.file)
+	}
+
+	r.Lock()
+	r.list = list
+	r.Unlock()
+	return nil
+}
+
+// changed reports whether the file described by info differs from the one
+// the list was last loaded from.
+func (r *RevokedKeys) changed(info os.FileInfo) bool {
+	r.RLock()
+	defer r.RUnlock()
+
+	return r.info == nil ||
+		!os.SameFile(r.info, info) ||
+		!r.info.ModTime().Equal(info.ModTime()) ||
+		r.info.Size() != info.Size()
+}
+
+// Watch reloads the revoked keys file whenever it changes, checking every
+// interval until ctx is done. If the new file can't be read, the last list
+// read is kept until it changes again.
+func (r *RevokedKeys) Watch(ctx context.Context, interval time.Duration) {
+	l := logrus.WithField("file", r.file)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		info, err := os.Stat(r.file)
+		if err != nil || !r.changed(info) {
+			continue
+		}
+
+		if err := r.Reload(); err != nil {
+			l.WithError(err).Warnln("Failed to reload revoked keys, keeping the previous ones")
+			continue
+		}
+		l.Infoln("Reloaded revoked keys")
+	}
+}
+
+// IsRevoked reports whether key is revoked.
+func (r *RevokedKeys) IsRevoked(key ssh.PublicKey) bool {
+	r.RLock()
+	defer r.RUnlock()
+
+	return r.list.revoked(key)
+}
@@ -0,0 +1,175 @@
+package auth
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// The keys of the fixtures of testdata, by the seed of testKey.
+const (
+	seedCA1 = iota + 1
+	seedCA2
+	seedExplicit
+	seedSHA1
+	seedSHA256
+	seedHash
+	seedUser
+)
+
+type revokedCase struct {
+	name    string
+	key     gossh.PublicKey
+	revoked bool
+}
+
+// certCase returns the case of a certificate of key, signed by ca with serial
+// and id.
+func certCase(t *testing.T, name string, ca gossh.Signer, key gossh.PublicKey, serial uint64, id string, revoked bool) revokedCase {
+	cert := testCert(t, ca, key, func(c *gossh.Certificate) {
+		c.Serial = serial
+		c.KeyId = id
+	})
+	return revokedCase{name, cert, revoked}
+}
+
+func checkRevoked(t *testing.T, r *RevokedKeys, tests []revokedCase) {
+	t.Helper()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := r.IsRevoked(tt.key); got != tt.revoked {
+				t.Errorf("got revoked %v, want %v", got, tt.revoked)
+			}
+		})
+	}
+}
+
+// TestKRL checks the key revocation list of testdata, made by
+//
+//	ssh-keygen -k -s ca1.pub -f revoked.krl revoked.krl.spec
+//	ssh-keygen -k -u -s ca2.pub -f revoked.krl revoked-ca2.krl.spec
+//
+// which has every kind of section and certificate section.
+func TestKRL(t *testing.T) {
+	r, err := NewRevokedKeys("testdata/revoked.krl")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ca1, ca2, user := testKey(t, seedCA1), testKey(t, seedCA2), testKey(t, seedUser).PublicKey()
+	explicit := testKey(t, seedExplicit).PublicKey()
+
+	checkRevoked(t, r, []revokedCase{
+		{"explicit key", explicit, true},
+		{"key by SHA1", testKey(t, seedSHA1).PublicKey(), true},
+		{"key by SHA256", testKey(t, seedSHA256).PublicKey(), true},
+		{"key by fingerprint", testKey(t, seedHash).PublicKey(), true},
+		{"other key", user, false},
+		{"authority key", ca1.PublicKey(), false},
+
+		certCase(t, "serial of a list", ca1, user, 1, "", true),
+		certCase(t, "serial missing from a list", ca1, user, 2, "", false),
+		certCase(t, "first serial of a bitmap", ca1, user, 1000, "", true),
+		certCase(t, "serial of a bitmap", ca1, user, 1004, "", true),
+		certCase(t, "last serial of a bitmap", ca1, user, 1010, "", true),
+		certCase(t, "serial missing from a bitmap", ca1, user, 1001, "", false),
+		certCase(t, "serial after a bitmap", ca1, user, 1012, "", false),
+		certCase(t, "first serial of a range", ca1, user, 10000, "", true),
+		certCase(t, "serial of a range", ca1, user, 150000, "", true),
+		certCase(t, "last serial of a range", ca1, user, 200000, "", true),
+		certCase(t, "serial before a range", ca1, user, 9999, "", false),
+		certCase(t, "serial after a range", ca1, user, 200001, "", false),
+		certCase(t, "key ID", ca1, user, 2, "revoked-id", true),
+		certCase(t, "other key ID", ca1, user, 2, "other-id", false),
+		certCase(t, "serial of the second authority", ca2, user, 7, "", true),
+		certCase(t, "serial of the first authority for the second", ca2, user, 1, "", false),
+		certCase(t, "key ID of the first authority for the second", ca2, user, 2, "revoked-id", false),
+		certCase(t, "serial of the second authority for the first", ca1, user, 7, "", false),
+		certCase(t, "certificate of a revoked key", ca1, explicit, 2, "", true),
+	})
+}
+
+func TestKRLErrors(t *testing.T) {
+	b, err := ioutil.ReadFile("testdata/revoked.krl")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	version := append([]byte{}, b...)
+	binary.BigEndian.PutUint32(version[len(krlMagic):], 2)
+
+	tests := []struct {
+		name string
+		krl  []byte
+	}{
+		{"truncated header", b[:len(krlMagic)+10]},
+		{"truncated section", b[:len(b)-10]},
+		{"unknown section", append(append([]byte{}, b...), 9, 0, 0, 0, 0)},
+		{"unsupported version", version},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := parseKRL(tt.krl); err == nil {
+				t.Error("parsed an invalid key revocation list")
+			}
+		})
+	}
+}
+
+// TestRevokedList checks the text list of testdata, which revokes serials and
+// key IDs of any authority.
+func TestRevokedList(t *testing.T) {
+	r, err := NewRevokedKeys("testdata/revoked.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ca1, ca2, user := testKey(t, seedCA1), testKey(t, seedCA2), testKey(t, seedUser).PublicKey()
+	explicit := testKey(t, seedExplicit).PublicKey()
+
+	checkRevoked(t, r, []revokedCase{
+		{"key", explicit, true},
+		{"key of a directive", testKey(t, seedSHA1).PublicKey(), true},
+		{"SHA256 fingerprint", testKey(t, seedSHA256).PublicKey(), true},
+		{"SHA1 fingerprint", testKey(t, seedHash).PublicKey(), true},
+		{"other key", user, false},
+
+		certCase(t, "serial", ca1, user, 1, "", true),
+		certCase(t, "serial of another authority", ca2, user, 1, "", true),
+		certCase(t, "first serial of a range", ca1, user, 10, "", true),
+		certCase(t, "last serial of a range", ca1, user, 20, "", true),
+		certCase(t, "serial before a range", ca1, user, 9, "", false),
+		certCase(t, "serial after a range", ca1, user, 21, "", false),
+		certCase(t, "key ID", ca2, user, 2, "revoked-id", true),
+		certCase(t, "other key ID", ca2, user, 2, "other-id", false),
+		certCase(t, "certificate of a revoked key", ca1, explicit, 2, "", true),
+	})
+}
+
+func TestRevokedListErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		line string
+	}{
+		{"unknown directive", "revoke: everything"},
+		{"invalid key", "ssh-ed25519 AAAA"},
+		{"invalid serial", "serial: first"},
+		{"reversed range", "serial: 20-10"},
+		{"invalid fingerprint", "hash: SHA256:short"},
+		{"unknown hash", "hash: MD5:Wm5uBdVW/UUx3iqoXicmBLQt1t8"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parseRevokedList(strings.NewReader("# comment\n\n" + tt.line + "\n"))
+			if err == nil {
+				t.Fatal("parsed an invalid line")
+			}
+			if !strings.Contains(err.Error(), "line 3") {
+				t.Errorf("got error %q, want it to name line 3", err)
+			}
+		})
+	}
+}
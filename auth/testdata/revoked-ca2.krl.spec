@@ -0,0 +1 @@
+serial: 7
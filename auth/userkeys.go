@@ -0,0 +1,234 @@
+package auth
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/gliderlabs/ssh"
+	"github.com/pkg/errors"
+)
+
+// DefaultUserKeysFiles are the authorized keys files of users OpenSSH reads by
+// default.
+var DefaultUserKeysFiles = []string{".ssh/authorized_keys", ".ssh/authorized_keys2"}
+
+// UserPublicKeyAuth authenticates users with the keys of their own authorized
+// keys files, like ~/.ssh/authorized_keys.
+type UserPublicKeyAuth struct {
+	users UserStore
+	runAs RunAs
+	files []string
+
+	// StrictModes makes the files be ignored unless they and the directories
+	// above them, up to the home directory, are owned by root or the user and
+	// writable by nobody else. It is on by default.
+	StrictModes bool
+
+	// cache has the keys of each user by path, so that a user never gets
+	// the keys of a file only another user could read.
+	mu    sync.Mutex
+	cache map[userPath]*userKeys
+}
+
+type userPath struct {
+	uid  uint32
+	path string
+}
+
+// userKeys are the keys parsed from a file, kept until it changes.
+type userKeys struct {
+	info os.FileInfo
+	keys *authorizedKeys
+}
+
+// NewUserPublicKeyAuth returns an authenticator reading the files of users
+// from users. Like OpenSSH's AuthorizedKeysFile, the files may contain %h for
+// the home directory, %u for the user name, %U for their uid and %% for %, and
+// relative paths are relative to the home directory. Without files, it reads
+// DefaultUserKeysFiles. The files are read through runAs with the credentials
+// of the user, as OpenSSH's temporarily_use_uid, so that a user can't have the
+// server read a file they can't read themselves.
+func NewUserPublicKeyAuth(users UserStore, runAs RunAs, files ...string) *UserPublicKeyAuth {
+	if len(files) == 0 {
+		files = DefaultUserKeysFiles
+	}
+
+	return &UserPublicKeyAuth{
+		users:       users,
+		runAs:       runAs,
+		files:       files,
+		StrictModes: true,
+		cache:       make(map[userPath]*userKeys),
+	}
+}
+
+// expandPath returns the path of the file described by pattern for u.
+func expandPath(pattern string, u *User) string {
+	r := strings.NewReplacer(
+		"%%", "%",
+		"%h", u.Home,
+		"%u", u.Name,
+		"%U", strconv.FormatUint(uint64(u.UID), 10),
+	)
+
+	path := r.Replace(pattern)
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(u.Home, path)
+	}
+	return path
+}
+
+// securePath checks file and the directories above it, up to the home
+// directory of u or the root, are owned by root or u and writable by nobody
+// else, like OpenSSH's StrictModes.
+func securePath(file string, u *User) error {
+	check := func(path string, info os.FileInfo) error {
+		st, ok := info.Sys().(*syscall.Stat_t)
+		if !ok {
+			return errors.Errorf("can't check owner of %s", path)
+		}
+		if st.Uid != 0 && st.Uid != u.UID {
+			return errors.Errorf("bad ownership of %s", path)
+		}
+		if info.Mode().Perm()&0022 != 0 {
+			return errors.Errorf("bad modes of %s", path)
+		}
+		return nil
+	}
+
+	info, err := os.Stat(file)
+	if err != nil {
+		return err
+	}
+	if !info.Mode().IsRegular() {
+		return errors.Errorf("%s is not a regular file", file)
+	}
+	if err := check(file, info); err != nil {
+		return err
+	}
+
+	home := filepath.Clean(u.Home)
+	for dir := filepath.Dir(file); ; dir = filepath.Dir(dir) {
+		info, err := os.Stat(dir)
+		if err != nil {
+			return err
+		}
+		if err := check(dir, info); err != nil {
+			return err
+		}
+		if dir == home || dir == "/" {
+			return nil
+		}
+	}
+}
+
+// keys returns the keys of the file at path for u, parsing it again only if it
+// changed since the last time. The file is read with the credentials of u.
+func (a *UserPublicKeyAuth) keys(path string, u *User) (keys *authorizedKeys, err error) {
+	err = a.runAs(u, func() error {
+		keys, err = a.readKeys(path, u)
+		return err
+	})
+	return keys, err
+}
+
+// readKeys returns the keys of the file at path for u, from the cache if the
+// file didn't change.
+func (a *UserPublicKeyAuth) readKeys(path string, u *User) (*authorizedKeys, error) {
+	// The checks apply to the file symbolic links point to, as OpenSSH does.
+	path, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if a.StrictModes {
+		if err := securePath(path, u); err != nil {
+			return nil, errors.Wrap(err, "authentication refused")
+		}
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	cacheKey := userPath{uid: u.UID, path: path}
+	a.mu.Lock()
+	cached, ok := a.cache[cacheKey]
+	a.mu.Unlock()
+	if ok && os.SameFile(cached.info, info) &&
+		cached.info.ModTime().Equal(info.ModTime()) &&
+		cached.info.Size() == info.Size() {
+		return cached.keys, nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	keys, err := parseAuthorizedKeys(f, logrus.WithFields(logrus.Fields{
+		"user": u.Name,
+		"file": path,
+	}))
+	if err != nil {
+		return nil, err
+	}
+
+	a.mu.Lock()
+	a.cache[cacheKey] = &userKeys{info: info, keys: keys}
+	a.mu.Unlock()
+	return keys, nil
+}
+
+func (a *UserPublicKeyAuth) Auth(ctx ssh.Context, key ssh.PublicKey) bool {
+	_, ok := a.AuthOptions(ctx, key)
+	return ok
+}
+
+// AuthOptions returns the options of the first line of key ctx may use, in
+// the first file it is in.
+func (a *UserPublicKeyAuth) AuthOptions(ctx ssh.Context, key ssh.PublicKey) (*KeyOptions, bool) {
+	l := logrus.WithFields(logrus.Fields{
+		"user":       ctx.User(),
+		"session_id": ctx.SessionID(),
+	})
+
+	u, err := a.users.Get(ctx.User())
+	if err != nil {
+		return nil, false
+	}
+
+	// A key revoked in any of the files is refused, even if another one
+	// accepts it.
+	var files []*authorizedKeys
+	for _, f := range a.files {
+		path := expandPath(f, u)
+		keys, err := a.keys(path, u)
+		if err != nil {
+			if !os.IsNotExist(errors.Cause(err)) {
+				l.WithField("file", path).WithError(err).Warnln("Failed to read authorized keys")
+			}
+			continue
+		}
+		if keys.isRevoked(key) {
+			l.WithField("file", path).Warnln("Refused revoked key")
+			return nil, false
+		}
+		files = append(files, keys)
+	}
+
+	for _, keys := range files {
+		if opts, ok := keys.accepted(ctx, key); ok {
+			return opts, true
+		}
+	}
+
+	return nil, false
+}
@@ -1,54 +1,179 @@
 package main
 
 import (
+	"context"
+	"expvar"
+	"flag"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
 	"github.com/Sirupsen/logrus"
-	"github.com/gliderlabs/ssh"
 	sshd "github.com/inoc603/go-sshd"
-	"github.com/inoc603/go-sshd/asciicast"
-	"github.com/inoc603/go-sshd/auth"
-	"github.com/inoc603/go-sshd/storage"
-	"github.com/pkg/errors"
+	"github.com/inoc603/go-sshd/config"
 )
 
+// upgradeTimeout is how long the new process may take to listen on SIGUSR2.
+const upgradeTimeout = time.Minute
+
 func exitOnErr(err error, msg string) {
 	if err != nil {
 		logrus.WithError(err).Fatalln(msg)
 	}
 }
 
-func main() {
-	pkAuth, err := auth.NewLocalPublicKeyAuth("/root/.ssh/authorized_keys")
-	exitOnErr(err, "Failed to create publick key auth")
+// shutdown shuts server down, and closes it right away on the next SIGINT or
+// SIGTERM.
+func shutdown(server *sshd.Server, cfg *config.Config, signals <-chan os.Signal) {
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	defer cancel()
+	go func() {
+		for sig := range signals {
+			if sig == syscall.SIGINT || sig == syscall.SIGTERM {
+				cancel()
+				return
+			}
+		}
+	}()
+
+	if err := server.Shutdown(ctx); err != nil {
+		logrus.WithError(err).Warnln("Sessions did not end in time")
+	}
+}
+
+// handleSignals shuts server down on SIGINT or SIGTERM, and reloads its
+// authorized keys on SIGHUP. On SIGUSR2, it starts a new process of the daemon
+// serving the same sockets, and lets the sessions of this one end. done is
+// closed once the server is stopped.
+func handleSignals(server *sshd.Server, cfg *config.Config, done chan<- struct{}) {
+	defer close(done)
+
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM, syscall.SIGUSR2, syscall.SIGHUP)
+
+	// drained is set once a new process serves the connections.
+	var drained chan error
+	for {
+		select {
+		case err := <-drained:
+			if err != nil {
+				logrus.WithError(err).Warnln("Failed to wait for sessions to end")
+			}
+			return
+		case sig := <-signals:
+			if sig == syscall.SIGHUP {
+				if err := server.Reload(); err != nil {
+					logrus.WithError(err).Errorln("Failed to reload, keeping the previous configuration")
+				} else {
+					logrus.Infoln("Reloaded")
+				}
+				continue
+			}
 
-	store, err := storage.NewFileStorage("tmp/output")
-	exitOnErr(err, "Failed to create output storage")
+			if sig != syscall.SIGUSR2 {
+				logrus.WithField("signal", sig).Infoln("Shutting down the server")
+				shutdown(server, cfg, signals)
+				return
+			}
 
-	newAsciinemaRecorder := func(s ssh.Session) (sshd.Recorder, error) {
-		output, err := store.New(s.Context().(ssh.Context))
+			if drained != nil {
+				logrus.Warnln("Already upgraded, waiting for sessions to end")
+				continue
+			}
+
+			logrus.Infoln("Upgrading the server")
+			ctx, cancel := context.WithTimeout(context.Background(), upgradeTimeout)
+			err := server.Upgrade(ctx)
+			cancel()
+			if err != nil {
+				logrus.WithError(err).Errorln("Failed to upgrade, still serving")
+				continue
+			}
+
+			drained = make(chan error, 1)
+			go func() {
+				drained <- server.Drain(context.Background())
+			}()
+		}
+	}
+}
+
+// writePIDFile writes the PID of the daemon to path, and returns a function
+// removing it unless another process took it over since.
+func writePIDFile(path string) (func(), error) {
+	pid := strconv.Itoa(os.Getpid())
+	if err := ioutil.WriteFile(path, []byte(pid+"\n"), 0644); err != nil {
+		return nil, err
+	}
+
+	return func() {
+		b, err := ioutil.ReadFile(path)
+		if err == nil && strings.TrimSpace(string(b)) == pid {
+			os.Remove(path)
+		}
+	}, nil
+}
+
+// serveMetrics serves the expvar metrics of the daemon at addr. After an
+// upgrade, the old process holds the address until it exits, so listening is
+// retried until then.
+func serveMetrics(addr string) {
+	l := logrus.WithField("address", addr)
+
+	for warned := false; ; time.Sleep(time.Second) {
+		ln, err := net.Listen("tcp", addr)
 		if err != nil {
-			return nil, errors.Wrap(err, "open output")
+			if !warned {
+				l.WithError(err).Warnln("Failed to serve metrics, retrying")
+				warned = true
+			}
+			continue
 		}
-		pty, _, _ := s.Pty()
-		rec := asciicast.NewRecorder(output)
-		return rec, rec.WriteHeader(asciicast.Header{
-			Version: 2,
-			Width:   pty.Window.Width,
-			Height:  pty.Window.Height,
-			Env: map[string]string{
-				"TERM": pty.Term,
-			},
-		})
-	}
-
-	server, err := sshd.NewServer(
-		sshd.WithAddress(":2222"),
-		sshd.WithAuth(pkAuth),
-		sshd.WithAuth(auth.NewPamPasswordAuth("passwd")),
-		sshd.WithUserStore(&auth.LocalUserStore{}),
-		sshd.WithHostFile("/etc/ssh/ssh_host_rsa_key"),
-		sshd.WithRecorder(newAsciinemaRecorder),
-	)
+
+		l.Infoln("Serving metrics")
+		err = http.Serve(ln, expvar.Handler())
+		l.WithError(err).Errorln("Stopped serving metrics")
+		return
+	}
+}
+
+func main() {
+	cfg, err := config.Parse(os.Args[0], os.Args[1:])
+	if err == flag.ErrHelp {
+		return
+	}
+	exitOnErr(err, "Invalid configuration")
+
+	cfg.Listeners, err = sshd.SystemdListeners()
+	exitOnErr(err, "Invalid sockets passed by systemd")
+
+	opts, err := cfg.Options()
+	exitOnErr(err, "Invalid configuration")
+
+	server, err := sshd.NewServer(opts...)
 	exitOnErr(err, "Failed to create ssh server")
 
-	exitOnErr(server.Start(), "Server stopped")
+	if cfg.PIDFile != "" {
+		removePIDFile, err := writePIDFile(cfg.PIDFile)
+		exitOnErr(err, "Failed to write PID file")
+		defer removePIDFile()
+	}
+
+	if cfg.MetricsListen != "" {
+		go serveMetrics(cfg.MetricsListen)
+	}
+
+	done := make(chan struct{})
+	go handleSignals(server, cfg, done)
+
+	if err := server.Start(); err != sshd.ErrServerClosed {
+		exitOnErr(err, "Server stopped")
+	}
+	<-done
 }
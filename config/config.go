@@ -0,0 +1,601 @@
+// Package config reads the configuration of the daemon from a YAML file and
+// command line flags, and turns it into options for sshd.NewServer.
+package config
+
+import (
+	"flag"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/gliderlabs/ssh"
+	sshd "github.com/inoc603/go-sshd"
+	"github.com/inoc603/go-sshd/asciicast"
+	"github.com/inoc603/go-sshd/auth"
+	"github.com/inoc603/go-sshd/fsuser"
+	"github.com/inoc603/go-sshd/sshdconfig"
+	"github.com/inoc603/go-sshd/storage"
+	"github.com/pkg/errors"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// Config is the configuration of the daemon. Every field but ShutdownTimeout,
+// PIDFile and MetricsListen maps onto an sshd.Option, and empty fields leave
+// the option out.
+type Config struct {
+	// SSHDConfig is the path of an OpenSSH sshd_config file to read instead
+	// of the other keys, except record_dir, auth_watch, pid_file,
+	// metrics_listen and the shutdown ones.
+	SSHDConfig string `yaml:"sshd_config"`
+
+	// Listen are the addresses to listen on, like :22 or [::1]:22, and the
+	// paths of Unix sockets, starting with /. A single address can be given
+	// instead of a list. It defaults to DefaultListen, unless there are
+	// Listeners.
+	Listen addressList `yaml:"listen"`
+
+	// Listeners are sockets to serve too, like the ones passed by systemd.
+	// They replace the addresses of sshd_config.
+	Listeners []net.Listener `yaml:"-"`
+
+	// HostKey is the path of the private host key. A key is generated every
+	// time the server starts without one.
+	HostKey string `yaml:"host_key"`
+
+	// AuthorizedKeys is the path of the authorized_keys file public key
+	// authentication checks.
+	AuthorizedKeys string `yaml:"authorized_keys"`
+
+	// UserAuthorizedKeys are the authorized keys files of every user, like
+	// .ssh/authorized_keys. They may contain %h for the home directory, %u
+	// for the user name and %U for their uid, and relative paths are
+	// relative to the home directory.
+	UserAuthorizedKeys []string `yaml:"user_authorized_keys"`
+
+	// TrustedUserCAKeys is the path of a file with the keys of the
+	// certificate authorities whose user certificates are accepted, in the
+	// format of authorized keys files.
+	TrustedUserCAKeys string `yaml:"trusted_user_ca_keys"`
+
+	// UserCAKeys are keys of more trusted certificate authorities, like
+	// "ssh-ed25519 AAAA... ca".
+	UserCAKeys []string `yaml:"user_ca_keys"`
+
+	// RevokedKeys is the path of a key revocation list made by ssh-keygen -k,
+	// or of a text list of revoked keys, fingerprints, certificate serials
+	// and key IDs. They are refused whatever the other keys say.
+	RevokedKeys string `yaml:"revoked_keys"`
+
+	// StrictModes ignores the files of users unless they and the
+	// directories above them are only writable by root and the user.
+	StrictModes bool `yaml:"strict_modes"`
+
+	// AuthWatch is how often the authorized keys files are checked for
+	// changes, which are reloaded. Zero disables it, leaving SIGHUP to
+	// reload them.
+	AuthWatch time.Duration `yaml:"auth_watch"`
+
+	// PAMService is the PAM service password authentication goes through.
+	PAMService string `yaml:"pam_service"`
+
+	// UserStore is where users are looked up. Only local, which reads
+	// /etc/passwd and /etc/group, is supported.
+	UserStore string `yaml:"user_store"`
+
+	// RecordDir is the directory sessions are recorded to as asciicasts.
+	RecordDir string `yaml:"record_dir"`
+
+	SFTP       bool `yaml:"sftp"`
+	BuiltinSCP bool `yaml:"builtin_scp"`
+
+	// AcceptEnv lists glob patterns of the environment variables clients may
+	// set.
+	AcceptEnv []string `yaml:"accept_env"`
+
+	// PermitUserEnvironment lists glob patterns of the environment
+	// variables the environment options of authorized keys may set.
+	PermitUserEnvironment []string `yaml:"permit_user_environment"`
+
+	AgentForwarding bool `yaml:"agent_forwarding"`
+
+	// NoAgentForwarding lists glob patterns of the users who may not forward
+	// their agent even though AgentForwarding is set.
+	NoAgentForwarding []string `yaml:"no_agent_forwarding"`
+
+	X11Forwarding bool `yaml:"x11_forwarding"`
+
+	// The forwarding rules are checked in order, and forwarding is disabled
+	// without any rule.
+	LocalForwarding       []ForwardRule     `yaml:"local_forwarding"`
+	RemoteForwarding      []ForwardRule     `yaml:"remote_forwarding"`
+	StreamLocalForwarding []StreamLocalRule `yaml:"streamlocal_forwarding"`
+
+	// Banner is the path of a file sent to clients before they authenticate.
+	Banner string `yaml:"banner"`
+
+	// PermitRootLogin is how root may log in: yes, prohibit-password,
+	// forced-commands-only or no.
+	PermitRootLogin string `yaml:"permit_root_login"`
+
+	// The users who may log in, as glob patterns of user names or of
+	// user@host, and groups. Deny lists are checked first.
+	AllowUsers  []string `yaml:"allow_users"`
+	DenyUsers   []string `yaml:"deny_users"`
+	AllowGroups []string `yaml:"allow_groups"`
+	DenyGroups  []string `yaml:"deny_groups"`
+
+	// ForceCommand is run instead of the commands of clients.
+	ForceCommand string `yaml:"force_command"`
+
+	// Clients are disconnected after not answering ClientAliveCountMax
+	// checks sent every ClientAliveInterval. Zero disables the checks.
+	ClientAliveInterval time.Duration `yaml:"client_alive_interval"`
+	ClientAliveCountMax int           `yaml:"client_alive_count_max"`
+
+	// IdleTimeout disconnects clients which stay silent that long. Zero
+	// disables it.
+	IdleTimeout time.Duration `yaml:"idle_timeout"`
+
+	// Match rules override settings for the connections they match, once
+	// clients have authenticated. They can only be set in the file.
+	Match []MatchRule `yaml:"match"`
+
+	// ShutdownMessage is sent to the clients of active sessions when the
+	// server shuts down. ShutdownTimeout is how long to wait for them to
+	// disconnect before closing their connections.
+	ShutdownMessage string        `yaml:"shutdown_message"`
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout"`
+
+	// PIDFile is the path of the file the daemon writes its PID to, so it
+	// can be sent signals.
+	PIDFile string `yaml:"pid_file"`
+
+	// MetricsListen is the address the metrics of the daemon are served on
+	// as JSON, like the number of attempts with revoked keys.
+	MetricsListen string `yaml:"metrics_listen"`
+}
+
+// DefaultListen is the address listened on without listen or Listeners.
+const DefaultListen = ":2222"
+
+// Default returns the configuration used for the keys missing from the
+// configuration file and flags.
+func Default() *Config {
+	return &Config{
+		HostKey:        "/etc/ssh/ssh_host_rsa_key",
+		AuthorizedKeys: "/root/.ssh/authorized_keys",
+		AuthWatch:      5 * time.Second,
+		StrictModes:    true,
+		PAMService:     "passwd",
+		UserStore:      "local",
+		RecordDir:      "tmp/output",
+		SFTP:           true,
+		BuiltinSCP:     true,
+
+		PermitRootLogin:     "yes",
+		ClientAliveCountMax: 3,
+
+		ShutdownMessage: "The server is shutting down.",
+		ShutdownTimeout: 30 * time.Second,
+	}
+}
+
+// Load reads the configuration file at path on top of the default
+// configuration. Unknown keys are errors.
+func Load(path string) (*Config, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "read config")
+	}
+
+	c := Default()
+	if err := yaml.UnmarshalStrict(b, c); err != nil {
+		return nil, errors.Wrapf(err, "parse config %s", path)
+	}
+
+	return c, nil
+}
+
+// Parse parses the command line flags in args, reading the configuration file
+// given by -config first if there is one. Flags take precedence over the
+// file.
+func Parse(name string, args []string) (*Config, error) {
+	// The first pass only finds the configuration file, as the values of the
+	// flags must be applied on top of it.
+	var file string
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.StringVar(&file, "config", "", "path of the YAML configuration file")
+	Default().RegisterFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	c := Default()
+	if file != "" {
+		var err error
+		if c, err = Load(file); err != nil {
+			return nil, err
+		}
+	}
+
+	fs = flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.StringVar(&file, "config", "", "path of the YAML configuration file")
+	c.RegisterFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	return c, c.Validate()
+}
+
+// RegisterFlags defines a flag for every key of the configuration, with the
+// values of c as defaults. Flags of lists can be repeated, and replace the
+// list of the configuration file.
+func (c *Config) RegisterFlags(fs *flag.FlagSet) {
+	fs.StringVar(&c.SSHDConfig, "sshd-config", c.SSHDConfig, "path of an OpenSSH sshd_config file to read instead of the other settings, except record-dir, auth-watch, pid-file, metrics-listen and the shutdown ones")
+	fs.Var(&stringList{list: (*[]string)(&c.Listen)}, "listen", "address or Unix socket path to listen on, can be repeated (default "+DefaultListen+" unless systemd passes sockets)")
+	fs.StringVar(&c.HostKey, "host-key", c.HostKey, "path of the private host key, empty to generate one")
+	fs.StringVar(&c.AuthorizedKeys, "authorized-keys", c.AuthorizedKeys, "path of the authorized_keys file, empty to disable public key authentication")
+	fs.Var(&stringList{list: &c.UserAuthorizedKeys}, "user-authorized-keys", "authorized keys file of every user, relative to their home directory, can be repeated")
+	fs.StringVar(&c.TrustedUserCAKeys, "trusted-user-ca-keys", c.TrustedUserCAKeys, "path of a file with the keys of the certificate authorities whose user certificates are accepted")
+	fs.Var(&stringList{list: &c.UserCAKeys}, "user-ca-keys", "key of a certificate authority whose user certificates are accepted, can be repeated")
+	fs.StringVar(&c.RevokedKeys, "revoked-keys", c.RevokedKeys, "path of a key revocation list or text list of revoked keys")
+	fs.BoolVar(&c.StrictModes, "strict-modes", c.StrictModes, "check the ownership and modes of the authorized keys files of users")
+	fs.DurationVar(&c.AuthWatch, "auth-watch", c.AuthWatch, "how often to check authorized keys files for changes, 0 to disable")
+	fs.StringVar(&c.PAMService, "pam-service", c.PAMService, "PAM service used for password authentication, empty to disable it")
+	fs.StringVar(&c.UserStore, "user-store", c.UserStore, "where users are looked up, only local is supported")
+	fs.StringVar(&c.RecordDir, "record-dir", c.RecordDir, "directory sessions are recorded to, empty to disable recording")
+	fs.BoolVar(&c.SFTP, "sftp", c.SFTP, "serve the sftp subsystem")
+	fs.BoolVar(&c.BuiltinSCP, "builtin-scp", c.BuiltinSCP, "serve scp in-process")
+	fs.Var(&stringList{list: &c.AcceptEnv}, "accept-env", "glob pattern of environment variables clients may set, can be repeated")
+	fs.Var(&stringList{list: &c.PermitUserEnvironment}, "permit-user-environment", "glob pattern of environment variables authorized keys may set, can be repeated")
+	fs.BoolVar(&c.AgentForwarding, "agent-forwarding", c.AgentForwarding, "allow agent forwarding")
+	fs.Var(&stringList{list: &c.NoAgentForwarding}, "no-agent-forwarding", "glob pattern of users who may not forward their agent, can be repeated")
+	fs.BoolVar(&c.X11Forwarding, "x11-forwarding", c.X11Forwarding, "allow X11 forwarding")
+	fs.Var(&forwardRuleList{list: &c.LocalForwarding}, "local-forwarding", `local forwarding rule like "allow users=alice hosts=*.internal ports=80,8000-8999", can be repeated`)
+	fs.Var(&forwardRuleList{list: &c.RemoteForwarding}, "remote-forwarding", `remote forwarding rule like "deny users=root", can be repeated`)
+	fs.Var(&streamLocalRuleList{list: &c.StreamLocalForwarding}, "streamlocal-forwarding", `Unix socket forwarding rule like "allow paths=/run/user/*/app.sock", can be repeated`)
+	fs.StringVar(&c.Banner, "banner", c.Banner, "path of a file sent to clients before they authenticate")
+	fs.StringVar(&c.PermitRootLogin, "permit-root-login", c.PermitRootLogin, "how root may log in: yes, prohibit-password, forced-commands-only or no")
+	fs.Var(&stringList{list: &c.AllowUsers}, "allow-users", "glob pattern of users, or user@host, who may log in, can be repeated")
+	fs.Var(&stringList{list: &c.DenyUsers}, "deny-users", "glob pattern of users, or user@host, who may not log in, can be repeated")
+	fs.Var(&stringList{list: &c.AllowGroups}, "allow-groups", "glob pattern of groups whose users may log in, can be repeated")
+	fs.Var(&stringList{list: &c.DenyGroups}, "deny-groups", "glob pattern of groups whose users may not log in, can be repeated")
+	fs.StringVar(&c.ForceCommand, "force-command", c.ForceCommand, "command run instead of the commands of clients")
+	fs.DurationVar(&c.ClientAliveInterval, "client-alive-interval", c.ClientAliveInterval, "how often to check clients are still there, 0 to disable")
+	fs.IntVar(&c.ClientAliveCountMax, "client-alive-count-max", c.ClientAliveCountMax, "unanswered checks after which clients are disconnected")
+	fs.DurationVar(&c.IdleTimeout, "idle-timeout", c.IdleTimeout, "how long clients may stay silent, 0 to disable")
+	fs.StringVar(&c.ShutdownMessage, "shutdown-message", c.ShutdownMessage, "message sent to active sessions on shutdown, empty to send none")
+	fs.DurationVar(&c.ShutdownTimeout, "shutdown-timeout", c.ShutdownTimeout, "how long to wait for sessions to end on shutdown")
+	fs.StringVar(&c.PIDFile, "pid-file", c.PIDFile, "path of the file to write the PID of the daemon to")
+	fs.StringVar(&c.MetricsListen, "metrics-listen", c.MetricsListen, "address to serve the metrics of the daemon on, empty to disable")
+}
+
+func validGlobs(key string, patterns []string) error {
+	for i, p := range patterns {
+		if _, err := path.Match(p, ""); err != nil {
+			return errors.Errorf("%s[%d]: invalid pattern %q", key, i, p)
+		}
+	}
+	return nil
+}
+
+// Validate checks the values of c, and names the offending key in the
+// returned error.
+func (c *Config) Validate() error {
+	if c.ShutdownTimeout < 0 {
+		return errors.New("shutdown_timeout: can't be negative")
+	}
+
+	if c.AuthWatch < 0 {
+		return errors.New("auth_watch: can't be negative")
+	}
+
+	if c.SSHDConfig != "" {
+		return nil
+	}
+
+	for i, addr := range c.Listen {
+		if strings.HasPrefix(addr, "/") {
+			continue
+		}
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			return errors.Errorf("listen[%d]: invalid address %q", i, addr)
+		}
+	}
+
+	if c.UserStore != "local" {
+		return errors.Errorf("user_store: unsupported user store %q", c.UserStore)
+	}
+
+	if err := validGlobs("accept_env", c.AcceptEnv); err != nil {
+		return err
+	}
+
+	if err := validGlobs("permit_user_environment", c.PermitUserEnvironment); err != nil {
+		return err
+	}
+
+	if err := validGlobs("no_agent_forwarding", c.NoAgentForwarding); err != nil {
+		return err
+	}
+
+	if _, err := sshd.ParseRootLogin(c.PermitRootLogin); err != nil {
+		return errors.Wrap(err, "permit_root_login")
+	}
+
+	for _, globs := range []struct {
+		key      string
+		patterns []string
+	}{
+		{"allow_users", c.AllowUsers},
+		{"deny_users", c.DenyUsers},
+		{"allow_groups", c.AllowGroups},
+		{"deny_groups", c.DenyGroups},
+	} {
+		if err := validGlobs(globs.key, globs.patterns); err != nil {
+			return err
+		}
+	}
+
+	if c.ClientAliveInterval < 0 || c.ClientAliveCountMax < 0 {
+		return errors.New("client_alive_interval and client_alive_count_max can't be negative")
+	}
+
+	if c.IdleTimeout < 0 {
+		return errors.New("idle_timeout: can't be negative")
+	}
+
+	if _, err := matchRules("match", c.Match); err != nil {
+		return err
+	}
+
+	for _, rules := range []struct {
+		key   string
+		rules []ForwardRule
+	}{
+		{"local_forwarding", c.LocalForwarding},
+		{"remote_forwarding", c.RemoteForwarding},
+	} {
+		if _, err := forwardPolicy(rules.key, rules.rules); err != nil {
+			return err
+		}
+	}
+
+	_, err := streamLocalPolicy("streamlocal_forwarding", c.StreamLocalForwarding)
+	return err
+}
+
+// Options returns the options of the server described by c, which must be
+// valid.
+func (c *Config) Options() ([]sshd.Option, error) {
+	var opts []sshd.Option
+	if c.SSHDConfig != "" {
+		sc, err := sshdconfig.Load(c.SSHDConfig)
+		if err != nil {
+			return nil, errors.Wrap(err, "sshd_config")
+		}
+		if opts, err = sc.Options(); err != nil {
+			return nil, errors.Wrap(err, "sshd_config")
+		}
+		return c.daemonOptions(opts)
+	}
+
+	rootLogin, err := sshd.ParseRootLogin(c.PermitRootLogin)
+	if err != nil {
+		return nil, errors.Wrap(err, "permit_root_login")
+	}
+
+	userStore := &auth.LocalUserStore{}
+
+	addrs := c.Listen
+	if len(addrs) == 0 && len(c.Listeners) == 0 {
+		addrs = []string{DefaultListen}
+	}
+
+	opts = append(opts,
+		sshd.WithAddress(addrs...),
+		sshd.WithUserStore(userStore),
+		sshd.WithPermitRootLogin(rootLogin),
+		sshd.WithClientAlive(c.ClientAliveInterval, c.ClientAliveCountMax),
+	)
+
+	if c.HostKey != "" {
+		if _, err := os.Stat(c.HostKey); err != nil {
+			return nil, errors.Wrap(err, "host_key")
+		}
+		opts = append(opts, sshd.WithHostFile(c.HostKey))
+	}
+
+	if c.AuthorizedKeys != "" {
+		pkAuth, err := auth.NewLocalPublicKeyAuth(c.AuthorizedKeys)
+		if err != nil {
+			return nil, errors.Wrap(err, "authorized_keys")
+		}
+		opts = append(opts, sshd.WithAuth(pkAuth))
+	}
+
+	if len(c.UserAuthorizedKeys) > 0 {
+		pkAuth := auth.NewUserPublicKeyAuth(userStore, fsuser.Run, c.UserAuthorizedKeys...)
+		pkAuth.StrictModes = c.StrictModes
+		opts = append(opts, sshd.WithAuth(pkAuth))
+	}
+
+	if c.TrustedUserCAKeys != "" {
+		pkAuth, err := auth.NewCertPublicKeyAuth(c.TrustedUserCAKeys)
+		if err != nil {
+			return nil, errors.Wrap(err, "trusted_user_ca_keys")
+		}
+		opts = append(opts, sshd.WithAuth(pkAuth))
+	}
+
+	if len(c.UserCAKeys) > 0 {
+		var keys []ssh.PublicKey
+		for _, k := range c.UserCAKeys {
+			pk, _, _, _, err := ssh.ParseAuthorizedKey([]byte(k))
+			if err != nil {
+				return nil, errors.Wrapf(err, "user_ca_keys %q", k)
+			}
+			keys = append(keys, pk)
+		}
+		opts = append(opts, sshd.WithAuth(auth.NewCertPublicKeyAuthKeys(keys...)))
+	}
+
+	if c.RevokedKeys != "" {
+		revoked, err := auth.NewRevokedKeys(c.RevokedKeys)
+		if err != nil {
+			return nil, errors.Wrap(err, "revoked_keys")
+		}
+		opts = append(opts, sshd.WithRevokedKeys(revoked))
+	}
+
+	if c.PAMService != "" {
+		opts = append(opts, sshd.WithAuth(auth.NewPamPasswordAuth(c.PAMService)))
+	}
+
+	if c.SFTP {
+		opts = append(opts, sshd.WithSubsystem("sftp", sshd.ServeSFTP))
+	}
+
+	if c.BuiltinSCP {
+		opts = append(opts, sshd.WithBuiltinSCP())
+	}
+
+	if len(c.AcceptEnv) > 0 {
+		opts = append(opts, sshd.WithAcceptEnv(c.AcceptEnv...))
+	}
+
+	if len(c.PermitUserEnvironment) > 0 {
+		opts = append(opts, sshd.WithPermitUserEnvironment(c.PermitUserEnvironment...))
+	}
+
+	if c.AgentForwarding {
+		opts = append(opts, sshd.WithAgentForwarding(c.NoAgentForwarding...))
+	}
+
+	if c.X11Forwarding {
+		opts = append(opts, sshd.WithX11Forwarding())
+	}
+
+	if len(c.LocalForwarding) > 0 {
+		policy, err := forwardPolicy("local_forwarding", c.LocalForwarding)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, sshd.WithLocalForwarding(policy))
+	}
+
+	if len(c.RemoteForwarding) > 0 {
+		policy, err := forwardPolicy("remote_forwarding", c.RemoteForwarding)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, sshd.WithRemoteForwarding(policy))
+	}
+
+	if len(c.StreamLocalForwarding) > 0 {
+		policy, err := streamLocalPolicy("streamlocal_forwarding", c.StreamLocalForwarding)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, sshd.WithStreamLocalForwarding(policy))
+	}
+
+	if c.Banner != "" {
+		b, err := ioutil.ReadFile(c.Banner)
+		if err != nil {
+			return nil, errors.Wrap(err, "banner")
+		}
+		opts = append(opts, sshd.WithBanner(string(b)))
+	}
+
+	if len(c.AllowUsers) > 0 {
+		opts = append(opts, sshd.WithAllowUsers(c.AllowUsers...))
+	}
+	if len(c.DenyUsers) > 0 {
+		opts = append(opts, sshd.WithDenyUsers(c.DenyUsers...))
+	}
+	if len(c.AllowGroups) > 0 {
+		opts = append(opts, sshd.WithAllowGroups(c.AllowGroups...))
+	}
+	if len(c.DenyGroups) > 0 {
+		opts = append(opts, sshd.WithDenyGroups(c.DenyGroups...))
+	}
+
+	if c.ForceCommand != "" {
+		opts = append(opts, sshd.WithForceCommand(c.ForceCommand))
+	}
+
+	if c.IdleTimeout > 0 {
+		opts = append(opts, sshd.WithIdleTimeout(c.IdleTimeout))
+	}
+
+	if len(c.Match) > 0 {
+		rules, err := matchRules("match", c.Match)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, sshd.WithMatch(rules...))
+	}
+
+	return c.daemonOptions(opts)
+}
+
+// daemonOptions adds the options sshd_config doesn't cover to opts: the
+// listeners, auth_watch, the recorder of record_dir and the shutdown message.
+func (c *Config) daemonOptions(opts []sshd.Option) ([]sshd.Option, error) {
+	if len(c.Listeners) > 0 {
+		if c.SSHDConfig != "" {
+			opts = append(opts, sshd.WithAddress())
+		}
+		opts = append(opts, sshd.WithListener(c.Listeners...))
+	}
+
+	opts = append(opts,
+		sshd.WithAuthWatch(c.AuthWatch),
+		sshd.WithShutdownMessage(c.ShutdownMessage),
+	)
+	if c.RecordDir == "" {
+		return opts, nil
+	}
+
+	store, err := storage.NewFileStorage(c.RecordDir)
+	if err != nil {
+		return nil, errors.Wrap(err, "record_dir")
+	}
+	return append(opts, sshd.WithRecorder(asciicastRecorder(store))), nil
+}
+
+// eventRecorder records the events of sessions in their asciicast.
+type eventRecorder struct {
+	*asciicast.Recorder
+}
+
+func (r eventRecorder) WriteEvent(e sshd.Event) {
+	r.Recorder.WriteEvent(e.Type, e.Fields)
+}
+
+// asciicastRecorder records sessions as asciicasts in store, along with their
+// events.
+func asciicastRecorder(store storage.Storage) sshd.RecorderFactory {
+	return func(s ssh.Session) (sshd.Recorder, error) {
+		output, err := store.New(s.Context().(ssh.Context))
+		if err != nil {
+			return nil, errors.Wrap(err, "open output")
+		}
+		pty, _, _ := s.Pty()
+		rec := asciicast.NewRecorder(output)
+		return eventRecorder{rec}, rec.WriteHeader(asciicast.Header{
+			Version: 2,
+			Width:   pty.Window.Width,
+			Height:  pty.Window.Height,
+			Command: s.RawCommand(),
+			Env: map[string]string{
+				"TERM": pty.Term,
+			},
+		})
+	}
+}
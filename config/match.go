@@ -0,0 +1,100 @@
+package config
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	sshd "github.com/inoc603/go-sshd"
+	"github.com/pkg/errors"
+)
+
+// MatchRule is the configuration of an sshd.MatchRule. The settings left out
+// are not overridden.
+type MatchRule struct {
+	Users        []string `yaml:"users"`
+	Groups       []string `yaml:"groups"`
+	Networks     []string `yaml:"networks"`
+	Methods      []string `yaml:"methods"`
+	Fingerprints []string `yaml:"fingerprints"`
+
+	Record                *bool              `yaml:"record"`
+	LocalForwarding       *[]ForwardRule     `yaml:"local_forwarding"`
+	RemoteForwarding      *[]ForwardRule     `yaml:"remote_forwarding"`
+	StreamLocalForwarding *[]StreamLocalRule `yaml:"streamlocal_forwarding"`
+	AgentForwarding       *bool              `yaml:"agent_forwarding"`
+	X11Forwarding         *bool              `yaml:"x11_forwarding"`
+	ForceCommand          *string            `yaml:"force_command"`
+	IdleTimeout           *time.Duration     `yaml:"idle_timeout"`
+	Subsystems            *[]string          `yaml:"subsystems"`
+}
+
+func matchRules(key string, rules []MatchRule) ([]sshd.MatchRule, error) {
+	var result []sshd.MatchRule
+
+	for i, r := range rules {
+		key := fmt.Sprintf("%s[%d]", key, i)
+		rule := sshd.MatchRule{
+			Users:        r.Users,
+			Groups:       r.Groups,
+			Methods:      r.Methods,
+			Fingerprints: r.Fingerprints,
+			Overrides: sshd.Overrides{
+				Record:          r.Record,
+				AgentForwarding: r.AgentForwarding,
+				X11Forwarding:   r.X11Forwarding,
+				ForceCommand:    r.ForceCommand,
+				IdleTimeout:     r.IdleTimeout,
+			},
+		}
+
+		if err := validGlobs(key+".users", r.Users); err != nil {
+			return nil, err
+		}
+		if err := validGlobs(key+".groups", r.Groups); err != nil {
+			return nil, err
+		}
+
+		for j, n := range r.Networks {
+			_, network, err := net.ParseCIDR(n)
+			if err != nil {
+				return nil, errors.Errorf("%s.networks[%d]: invalid network %q", key, j, n)
+			}
+			rule.Networks = append(rule.Networks, network)
+		}
+
+		for j, m := range r.Methods {
+			if m != "publickey" && m != "password" {
+				return nil, errors.Errorf("%s.methods[%d]: unsupported method %q", key, j, m)
+			}
+		}
+
+		if r.IdleTimeout != nil && *r.IdleTimeout < 0 {
+			return nil, errors.Errorf("%s.idle_timeout: can't be negative", key)
+		}
+
+		var err error
+		if r.LocalForwarding != nil {
+			if rule.Overrides.LocalForwarding, err = forwardPolicy(key+".local_forwarding", *r.LocalForwarding); err != nil {
+				return nil, err
+			}
+		}
+		if r.RemoteForwarding != nil {
+			if rule.Overrides.RemoteForwarding, err = forwardPolicy(key+".remote_forwarding", *r.RemoteForwarding); err != nil {
+				return nil, err
+			}
+		}
+		if r.StreamLocalForwarding != nil {
+			if rule.Overrides.StreamLocalForwarding, err = streamLocalPolicy(key+".streamlocal_forwarding", *r.StreamLocalForwarding); err != nil {
+				return nil, err
+			}
+		}
+		if r.Subsystems != nil {
+			rule.Overrides.Subsystems = append([]string{}, *r.Subsystems...)
+		}
+
+		result = append(result, rule)
+	}
+
+	return result, nil
+}
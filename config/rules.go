@@ -0,0 +1,264 @@
+package config
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	sshd "github.com/inoc603/go-sshd"
+	"github.com/pkg/errors"
+)
+
+// ForwardRule is the configuration of an sshd.ForwardRule. Ports are single
+// ports like 22 or ranges like 8000-8999.
+type ForwardRule struct {
+	Deny     bool     `yaml:"deny"`
+	Users    []string `yaml:"users"`
+	Hosts    []string `yaml:"hosts"`
+	Networks []string `yaml:"networks"`
+	Ports    []string `yaml:"ports"`
+}
+
+// StreamLocalRule is the configuration of an sshd.StreamLocalRule.
+type StreamLocalRule struct {
+	Deny  bool     `yaml:"deny"`
+	Users []string `yaml:"users"`
+	Paths []string `yaml:"paths"`
+}
+
+func parsePort(s string) (uint32, error) {
+	port, err := strconv.ParseUint(s, 10, 16)
+	if err != nil || port == 0 {
+		return 0, errors.Errorf("invalid port %q", s)
+	}
+	return uint32(port), nil
+}
+
+// ParsePortRange parses a single port like 22, or a range of ports like
+// 8000-8999.
+func ParsePortRange(s string) (sshd.PortRange, error) {
+	parts := strings.SplitN(s, "-", 2)
+
+	from, err := parsePort(parts[0])
+	if err != nil {
+		return sshd.PortRange{}, err
+	}
+	if len(parts) == 1 {
+		return sshd.PortRange{From: from, To: from}, nil
+	}
+
+	to, err := parsePort(parts[1])
+	if err != nil {
+		return sshd.PortRange{}, err
+	}
+	if to < from {
+		return sshd.PortRange{}, errors.Errorf("invalid port range %q", s)
+	}
+
+	return sshd.PortRange{From: from, To: to}, nil
+}
+
+func forwardPolicy(key string, rules []ForwardRule) (sshd.ForwardPolicy, error) {
+	policy := sshd.ForwardPolicy{}
+
+	for i, r := range rules {
+		key := fmt.Sprintf("%s[%d]", key, i)
+		rule := sshd.ForwardRule{
+			Deny:  r.Deny,
+			Users: r.Users,
+			Hosts: r.Hosts,
+		}
+
+		if err := validGlobs(key+".users", r.Users); err != nil {
+			return nil, err
+		}
+		if err := validGlobs(key+".hosts", r.Hosts); err != nil {
+			return nil, err
+		}
+
+		for j, n := range r.Networks {
+			_, network, err := net.ParseCIDR(n)
+			if err != nil {
+				return nil, errors.Errorf("%s.networks[%d]: invalid network %q", key, j, n)
+			}
+			rule.Networks = append(rule.Networks, network)
+		}
+
+		for j, p := range r.Ports {
+			pr, err := ParsePortRange(p)
+			if err != nil {
+				return nil, errors.Wrapf(err, "%s.ports[%d]", key, j)
+			}
+			rule.Ports = append(rule.Ports, pr)
+		}
+
+		policy = append(policy, rule)
+	}
+
+	return policy, nil
+}
+
+func streamLocalPolicy(key string, rules []StreamLocalRule) (sshd.StreamLocalPolicy, error) {
+	policy := sshd.StreamLocalPolicy{}
+
+	for i, r := range rules {
+		key := fmt.Sprintf("%s[%d]", key, i)
+		if err := validGlobs(key+".users", r.Users); err != nil {
+			return nil, err
+		}
+		if err := validGlobs(key+".paths", r.Paths); err != nil {
+			return nil, err
+		}
+
+		policy = append(policy, sshd.StreamLocalRule{
+			Deny:  r.Deny,
+			Users: r.Users,
+			Paths: r.Paths,
+		})
+	}
+
+	return policy, nil
+}
+
+// parseRule parses the allow or deny keyword and the key=value,... fields of
+// a rule given on the command line.
+func parseRule(s string, keys ...string) (bool, map[string][]string, error) {
+	fields := strings.Fields(s)
+	if len(fields) == 0 {
+		return false, nil, errors.New("empty rule")
+	}
+
+	var deny bool
+	switch fields[0] {
+	case "allow":
+	case "deny":
+		deny = true
+	default:
+		return false, nil, errors.Errorf("rule %q must start with allow or deny", s)
+	}
+
+	values := make(map[string][]string)
+	for _, f := range fields[1:] {
+		parts := strings.SplitN(f, "=", 2)
+		if len(parts) != 2 {
+			return false, nil, errors.Errorf("invalid field %q in rule %q", f, s)
+		}
+
+		known := false
+		for _, k := range keys {
+			known = known || k == parts[0]
+		}
+		if !known {
+			return false, nil, errors.Errorf("unknown field %q in rule %q", parts[0], s)
+		}
+
+		values[parts[0]] = append(values[parts[0]], strings.Split(parts[1], ",")...)
+	}
+
+	return deny, values, nil
+}
+
+// addressList is a list of addresses, which can be given as a single one in
+// the configuration file.
+type addressList []string
+
+func (l *addressList) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var addr string
+	if err := unmarshal(&addr); err == nil {
+		*l = addressList{addr}
+		return nil
+	}
+
+	var addrs []string
+	if err := unmarshal(&addrs); err != nil {
+		return err
+	}
+	*l = addrs
+	return nil
+}
+
+// stringList is a flag of a list of strings, which replaces its default value
+// the first time it is set.
+type stringList struct {
+	list *[]string
+	set  bool
+}
+
+func (l *stringList) String() string {
+	if l.list == nil {
+		return ""
+	}
+	return strings.Join(*l.list, ",")
+}
+
+func (l *stringList) Set(s string) error {
+	if !l.set {
+		*l.list = nil
+		l.set = true
+	}
+	*l.list = append(*l.list, s)
+	return nil
+}
+
+// forwardRuleList is a flag of forwarding rules, which replaces its default
+// value the first time it is set.
+type forwardRuleList struct {
+	list *[]ForwardRule
+	set  bool
+}
+
+func (l *forwardRuleList) String() string {
+	return ""
+}
+
+func (l *forwardRuleList) Set(s string) error {
+	deny, values, err := parseRule(s, "users", "hosts", "networks", "ports")
+	if err != nil {
+		return err
+	}
+
+	if !l.set {
+		*l.list = nil
+		l.set = true
+	}
+	*l.list = append(*l.list, ForwardRule{
+		Deny:     deny,
+		Users:    values["users"],
+		Hosts:    values["hosts"],
+		Networks: values["networks"],
+		Ports:    values["ports"],
+	})
+
+	return nil
+}
+
+// streamLocalRuleList is a flag of Unix socket forwarding rules, which
+// replaces its default value the first time it is set.
+type streamLocalRuleList struct {
+	list *[]StreamLocalRule
+	set  bool
+}
+
+func (l *streamLocalRuleList) String() string {
+	return ""
+}
+
+func (l *streamLocalRuleList) Set(s string) error {
+	deny, values, err := parseRule(s, "users", "paths")
+	if err != nil {
+		return err
+	}
+
+	if !l.set {
+		*l.list = nil
+		l.set = true
+	}
+	*l.list = append(*l.list, StreamLocalRule{
+		Deny:  deny,
+		Users: values["users"],
+		Paths: values["paths"],
+	})
+
+	return nil
+}
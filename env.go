@@ -0,0 +1,90 @@
+package sshd
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/gliderlabs/ssh"
+	"github.com/inoc603/go-sshd/auth"
+)
+
+const (
+	defaultPath = "/usr/local/bin:/usr/bin:/bin"
+	rootPath    = "/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"
+)
+
+// setenv sets key to value in env, replacing an existing value.
+func setenv(env []string, key, value string) []string {
+	prefix := key + "="
+	for i, kv := range env {
+		if strings.HasPrefix(kv, prefix) {
+			env[i] = prefix + value
+			return env
+		}
+	}
+	return append(env, prefix+value)
+}
+
+// acceptEnv reports whether the client may set the variable name.
+func (s *Server) acceptEnv(name string) bool {
+	return len(s.acceptedEnv) > 0 && matchAny(s.acceptedEnv, name)
+}
+
+// hostPort splits addr into the host and port SSH_CLIENT and SSH_CONNECTION
+// are made of. Like OpenSSH, connections over Unix sockets come from
+// UNKNOWN port 65535.
+func hostPort(addr net.Addr) (string, string) {
+	if addr.Network() == "unix" {
+		return "UNKNOWN", "65535"
+	}
+	host, port, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String(), "0"
+	}
+	return host, port
+}
+
+// environ returns the login environment of user for session. Variables sent
+// by the client are only kept if accepted, followed by the permitted ones of
+// the key it authenticated with. Neither can override the variables describing
+// the connection.
+func (s *Server) environ(session ssh.Session, user *auth.User) []string {
+	path := defaultPath
+	if user.UID == 0 {
+		path = rootPath
+	}
+
+	env := []string{
+		"HOME=" + user.Home,
+		"USER=" + user.Name,
+		"LOGNAME=" + user.Name,
+		"SHELL=" + user.Shell,
+		"PATH=" + path,
+		"MAIL=/var/mail/" + user.Name,
+	}
+
+	if ptyReq, _, isPty := session.Pty(); isPty {
+		env = setenv(env, "TERM", ptyReq.Term)
+	}
+
+	for _, kv := range session.Environ() {
+		parts := strings.SplitN(kv, "=", 2)
+		if len(parts) != 2 || !s.acceptEnv(parts[0]) {
+			continue
+		}
+		env = setenv(env, parts[0], parts[1])
+	}
+
+	for _, kv := range s.keyEnvironment(session.Context().(ssh.Context)) {
+		parts := strings.SplitN(kv, "=", 2)
+		env = setenv(env, parts[0], parts[1])
+	}
+
+	clientHost, clientPort := hostPort(session.RemoteAddr())
+	serverHost, serverPort := hostPort(session.LocalAddr())
+	env = setenv(env, "SSH_CLIENT", fmt.Sprintf("%s %s %s", clientHost, clientPort, serverPort))
+	env = setenv(env, "SSH_CONNECTION", fmt.Sprintf("%s %s %s %s", clientHost, clientPort, serverHost, serverPort))
+
+	return env
+}
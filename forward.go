@@ -0,0 +1,414 @@
+package sshd
+
+import (
+	"io"
+	"net"
+	"path"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/gliderlabs/ssh"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// PortRange is an inclusive range of ports.
+type PortRange struct {
+	From uint32
+	To   uint32
+}
+
+// ForwardRule allows or denies tunnels of the users it lists to the
+// destinations it matches. An empty field matches everything.
+type ForwardRule struct {
+	Deny bool
+
+	// Users are the names of the users the rule applies to.
+	Users []string
+
+	// Hosts are glob patterns matched against the host name sent by the
+	// client, like *.example.com.
+	Hosts []string
+
+	// Networks are matched against the address the host name resolves to.
+	Networks []*net.IPNet
+
+	Ports []PortRange
+}
+
+func matchAny(patterns []string, s string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	for _, p := range patterns {
+		if ok, _ := path.Match(p, s); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (r ForwardRule) matches(user, host string, ip net.IP, port uint32) bool {
+	if !matchAny(r.Users, user) || !matchAny(r.Hosts, host) {
+		return false
+	}
+
+	if len(r.Networks) > 0 {
+		found := false
+		for _, n := range r.Networks {
+			if ip != nil && n.Contains(ip) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	if len(r.Ports) > 0 {
+		found := false
+		for _, pr := range r.Ports {
+			if port >= pr.From && port <= pr.To {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	return true
+}
+
+// ForwardPolicy decides which tunnels are allowed. The first rule matching a
+// tunnel decides, and tunnels matching no rule are denied.
+type ForwardPolicy []ForwardRule
+
+// Allowed reports whether user may forward to port of host, which resolved
+// to ip.
+func (p ForwardPolicy) Allowed(user, host string, ip net.IP, port uint32) bool {
+	for _, r := range p {
+		if r.matches(user, host, ip, port) {
+			return !r.Deny
+		}
+	}
+	return false
+}
+
+// directTCPIP is the payload of a direct-tcpip channel, as specified in
+// RFC 4254, section 7.2.
+type directTCPIP struct {
+	DestAddr   string
+	DestPort   uint32
+	OriginAddr string
+	OriginPort uint32
+}
+
+// tunnel copies data between the channel and the connection until both sides
+// are done, and records how much went each way.
+func (s *Server) tunnel(ctx ssh.Context, typ string, ch gossh.Channel, conn net.Conn, fields map[string]interface{}) {
+	start := time.Now()
+
+	var in, out int64
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		out, _ = io.Copy(conn, ch)
+		if c, ok := conn.(interface{ CloseWrite() error }); ok {
+			c.CloseWrite()
+		} else {
+			conn.Close()
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		in, _ = io.Copy(ch, conn)
+		ch.CloseWrite()
+	}()
+	wg.Wait()
+
+	ch.Close()
+	conn.Close()
+
+	fields["bytes_in"] = in
+	fields["bytes_out"] = out
+	fields["duration"] = time.Since(start).String()
+	s.recordEvent(ctx, nil, Event{Type: typ, Fields: fields})
+}
+
+// handleDirectTCPIP opens a tunnel for ssh -L. The host is resolved before
+// the policy is checked, and the checked address is the one dialed.
+func (s *Server) handleDirectTCPIP(srv *ssh.Server, conn *gossh.ServerConn, newChan gossh.NewChannel, ctx ssh.Context) {
+	settings := s.settings(ctx)
+	policy := settings.localForwarding
+	if policy == nil {
+		newChan.Reject(gossh.Prohibited, "port forwarding is not allowed")
+		return
+	}
+
+	var d directTCPIP
+	if err := gossh.Unmarshal(newChan.ExtraData(), &d); err != nil {
+		newChan.Reject(gossh.ConnectionFailed, "error parsing forward data: "+err.Error())
+		return
+	}
+
+	l := logrus.WithFields(logrus.Fields{
+		"user":        ctx.User(),
+		"session_id":  ctx.SessionID(),
+		"destination": net.JoinHostPort(d.DestAddr, strconv.Itoa(int(d.DestPort))),
+	})
+
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, d.DestAddr)
+	if err != nil || len(addrs) == 0 {
+		l.WithError(err).Warnln("Failed to resolve forward destination")
+		newChan.Reject(gossh.ConnectionFailed, "failed to resolve destination")
+		return
+	}
+	ip := addrs[0].IP
+
+	if !policy.Allowed(ctx.User(), d.DestAddr, ip, d.DestPort) || !settings.openAllowed(d.DestAddr, d.DestPort) {
+		l.Warnln("Port forwarding denied")
+		newChan.Reject(gossh.Prohibited, "port forwarding is not allowed")
+		return
+	}
+
+	var dialer net.Dialer
+	dconn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(ip.String(), strconv.Itoa(int(d.DestPort))))
+	if err != nil {
+		l.WithError(err).Warnln("Failed to connect to forward destination")
+		newChan.Reject(gossh.ConnectionFailed, err.Error())
+		return
+	}
+
+	ch, reqs, err := newChan.Accept()
+	if err != nil {
+		dconn.Close()
+		return
+	}
+	go gossh.DiscardRequests(reqs)
+
+	s.tunnel(ctx, "direct-tcpip", ch, dconn, map[string]interface{}{
+		"destination": net.JoinHostPort(d.DestAddr, strconv.Itoa(int(d.DestPort))),
+		"address":     dconn.RemoteAddr().String(),
+		"originator":  net.JoinHostPort(d.OriginAddr, strconv.Itoa(int(d.OriginPort))),
+	})
+}
+
+// remoteForward is the payload of tcpip-forward and cancel-tcpip-forward
+// requests, as specified in RFC 4254, section 7.1.
+type remoteForward struct {
+	BindAddr string
+	BindPort uint32
+}
+
+// forwardedTCPIP is the payload of a forwarded-tcpip channel, as specified in
+// RFC 4254, section 7.2.
+type forwardedTCPIP struct {
+	Addr       string
+	Port       uint32
+	OriginAddr string
+	OriginPort uint32
+}
+
+// remoteForwards keeps track of the listeners opened for a connection.
+type remoteForwards struct {
+	sync.Mutex
+	listeners map[string]net.Listener
+}
+
+var contextKeyRemoteForwards = &struct{ name string }{"remote-forwards"}
+
+// getRemoteForwards returns the listeners of the connection of ctx.
+func getRemoteForwards(ctx ssh.Context) *remoteForwards {
+	return ctx.Value(contextKeyRemoteForwards).(*remoteForwards)
+}
+
+// trackRemoteForwards sets up the listeners of the connection of ctx, which
+// are closed when the connection is. It must be called before any request is
+// handled, as the context can't be changed safely afterwards.
+func trackRemoteForwards(ctx ssh.Context) {
+	f := &remoteForwards{listeners: make(map[string]net.Listener)}
+	ctx.SetValue(contextKeyRemoteForwards, f)
+
+	go func() {
+		<-ctx.Done()
+		f.Lock()
+		defer f.Unlock()
+		for key, ln := range f.listeners {
+			ln.Close()
+			delete(f.listeners, key)
+		}
+	}()
+}
+
+// add registers ln under key, or reports false if the connection has closed
+// while the listener was set up.
+func (f *remoteForwards) add(ctx ssh.Context, key string, ln net.Listener) bool {
+	f.Lock()
+	defer f.Unlock()
+	if ctx.Err() != nil {
+		return false
+	}
+	f.listeners[key] = ln
+	return true
+}
+
+// remove closes the listener registered under key.
+func (f *remoteForwards) remove(key string) bool {
+	f.Lock()
+	defer f.Unlock()
+	ln, ok := f.listeners[key]
+	if !ok {
+		return false
+	}
+	delete(f.listeners, key)
+	ln.Close()
+	return true
+}
+
+// acceptForwards opens a channel of type typ back to the client for every
+// connection accepted on ln, until ln is closed. open returns the payload of
+// the channel and the fields to record for the connection.
+func (s *Server) acceptForwards(ctx ssh.Context, ln net.Listener, typ string, l *logrus.Entry, open func(c net.Conn) ([]byte, map[string]interface{})) {
+	conn := ctx.Value(ssh.ContextKeyConn).(gossh.Conn)
+
+	l.Infoln("Remote forwarding started")
+	defer l.Infoln("Remote forwarding stopped")
+
+	for {
+		c, err := ln.Accept()
+		if err != nil {
+			return
+		}
+
+		go func() {
+			payload, fields := open(c)
+			ch, reqs, err := conn.OpenChannel(typ, payload)
+			if err != nil {
+				l.WithError(err).Warnln("Failed to open forwarded channel")
+				c.Close()
+				return
+			}
+			go gossh.DiscardRequests(reqs)
+
+			s.tunnel(ctx, typ, ch, c, fields)
+		}()
+	}
+}
+
+// listenAddr converts the bind address sent by the client to the one to
+// listen on, and the address to check the policy with.
+func listenAddr(bindAddr string) (string, net.IP) {
+	switch bindAddr {
+	case "", "*", "0.0.0.0", "::":
+		return "", net.IPv4zero
+	case "localhost":
+		return "localhost", net.IPv4(127, 0, 0, 1)
+	}
+
+	if ip := net.ParseIP(bindAddr); ip != nil {
+		return bindAddr, ip
+	}
+
+	if addrs, err := net.LookupIP(bindAddr); err == nil && len(addrs) > 0 {
+		return addrs[0].String(), addrs[0]
+	}
+
+	return bindAddr, nil
+}
+
+// handleTCPIPForward opens a listener for ssh -R, and forwards the connections
+// it accepts back to the client.
+func (s *Server) handleTCPIPForward(ctx ssh.Context, srv *ssh.Server, req *gossh.Request) (bool, []byte) {
+	settings := s.settings(ctx)
+	policy := settings.remoteForwarding
+	if policy == nil {
+		return false, nil
+	}
+
+	var r remoteForward
+	if err := gossh.Unmarshal(req.Payload, &r); err != nil {
+		return false, nil
+	}
+
+	l := logrus.WithFields(logrus.Fields{
+		"user":       ctx.User(),
+		"session_id": ctx.SessionID(),
+		"bind":       net.JoinHostPort(r.BindAddr, strconv.Itoa(int(r.BindPort))),
+	})
+
+	host, ip := listenAddr(r.BindAddr)
+
+	// Like OpenSSH, only root may listen on privileged ports.
+	if r.BindPort != 0 && r.BindPort < 1024 {
+		if user, err := s.userStore.Get(ctx.User()); err != nil || user.UID != 0 {
+			l.Warnln("Remote forwarding of privileged port denied")
+			return false, nil
+		}
+	}
+
+	allowed := func(port uint32) bool {
+		return policy.Allowed(ctx.User(), r.BindAddr, ip, port) && settings.listenAllowed(r.BindAddr, port)
+	}
+
+	if r.BindPort != 0 && !allowed(r.BindPort) {
+		l.Warnln("Remote forwarding denied")
+		return false, nil
+	}
+
+	ln, err := net.Listen("tcp", net.JoinHostPort(host, strconv.Itoa(int(r.BindPort))))
+	if err != nil {
+		l.WithError(err).Warnln("Failed to listen for remote forwarding")
+		return false, nil
+	}
+
+	_, portStr, _ := net.SplitHostPort(ln.Addr().String())
+	port, _ := strconv.Atoi(portStr)
+
+	// A port picked by the system can only be checked once it's known.
+	if r.BindPort == 0 && !allowed(uint32(port)) {
+		ln.Close()
+		l.WithField("port", port).Warnln("Remote forwarding denied")
+		return false, nil
+	}
+
+	key := net.JoinHostPort(r.BindAddr, strconv.Itoa(port))
+	if !getRemoteForwards(ctx).add(ctx, key, ln) {
+		ln.Close()
+		return false, nil
+	}
+
+	go s.acceptForwards(ctx, ln, "forwarded-tcpip", l.WithField("port", port), func(c net.Conn) ([]byte, map[string]interface{}) {
+		originAddr, originPort, _ := net.SplitHostPort(c.RemoteAddr().String())
+		p, _ := strconv.Atoi(originPort)
+
+		payload := gossh.Marshal(&forwardedTCPIP{
+			Addr:       r.BindAddr,
+			Port:       uint32(port),
+			OriginAddr: originAddr,
+			OriginPort: uint32(p),
+		})
+
+		return payload, map[string]interface{}{
+			"bind":       key,
+			"originator": c.RemoteAddr().String(),
+		}
+	})
+
+	return true, gossh.Marshal(&struct{ Port uint32 }{uint32(port)})
+}
+
+// handleCancelTCPIPForward closes a listener opened by handleTCPIPForward.
+func (s *Server) handleCancelTCPIPForward(ctx ssh.Context, srv *ssh.Server, req *gossh.Request) (bool, []byte) {
+	var r remoteForward
+	if err := gossh.Unmarshal(req.Payload, &r); err != nil {
+		return false, nil
+	}
+
+	key := net.JoinHostPort(r.BindAddr, strconv.Itoa(int(r.BindPort)))
+	return getRemoteForwards(ctx).remove(key), nil
+}
@@ -0,0 +1,33 @@
+// Package fsuser runs code with the filesystem credentials of a user without
+// changing the credentials of the whole process.
+package fsuser
+
+import (
+	"runtime"
+
+	"github.com/inoc603/go-sshd/auth"
+)
+
+// Run calls fn on a new goroutine locked to its own OS thread, after switching
+// that thread's filesystem uid, gid and supplementary groups to those of u.
+// Every file fn opens, creates or removes is subject to u's permissions.
+//
+// The thread is never unlocked, so the runtime throws it away once fn returns
+// and the credentials can't leak into other goroutines. fn must not start
+// goroutines that access the filesystem, as they run on other threads.
+func Run(u *auth.User, fn func() error) error {
+	errc := make(chan error, 1)
+
+	go func() {
+		runtime.LockOSThread()
+
+		if err := setCredentials(u); err != nil {
+			errc <- err
+			return
+		}
+
+		errc <- fn()
+	}()
+
+	return <-errc
+}
@@ -0,0 +1,60 @@
+package fsuser
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/inoc603/go-sshd/auth"
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// fsid returns the filesystem id of the calling thread from the given line of
+// /proc/thread-self/status, which lists the real, effective, saved and
+// filesystem ids in that order.
+func fsid(key string) (string, error) {
+	f, err := os.Open("/proc/thread-self/status")
+	if err != nil {
+		return "", errors.Wrap(err, "open thread status")
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 5 && fields[0] == key+":" {
+			return fields[4], nil
+		}
+	}
+
+	return "", errors.Errorf("%s not found in thread status", key)
+}
+
+func setCredentials(u *auth.User) error {
+	// Unlike their counterparts in the syscall package, which apply to every
+	// thread of the process, these only change the calling thread.
+	var groups []int
+	for _, gid := range u.GroupIDs() {
+		groups = append(groups, int(gid))
+	}
+	if err := unix.Setgroups(groups); err != nil {
+		return errors.Wrap(err, "set groups")
+	}
+	unix.Setfsgid(int(u.GID))
+	unix.Setfsuid(int(u.UID))
+
+	// setfsuid(2) and setfsgid(2) don't report failures, so read the ids back.
+	for key, want := range map[string]uint32{"Gid": u.GID, "Uid": u.UID} {
+		got, err := fsid(key)
+		if err != nil {
+			return err
+		}
+		if got != fmt.Sprint(want) {
+			return errors.Errorf("failed to set filesystem %s to %d", strings.ToLower(key), want)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+// +build !linux
+
+package fsuser
+
+import (
+	"github.com/inoc603/go-sshd/auth"
+	"github.com/pkg/errors"
+)
+
+func setCredentials(u *auth.User) error {
+	return errors.New("filesystem credentials are only supported on linux")
+}
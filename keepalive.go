@@ -0,0 +1,46 @@
+package sshd
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/gliderlabs/ssh"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// keepAlive checks the client of conn is still there every interval, and
+// closes the connection once more than countMax checks in a row went
+// unanswered.
+func (s *Server) keepAlive(ctx ssh.Context, conn *gossh.ServerConn) {
+	l := logrus.WithFields(logrus.Fields{
+		"user":       ctx.User(),
+		"session_id": ctx.SessionID(),
+	})
+
+	ticker := time.NewTicker(s.clientAliveInterval)
+	defer ticker.Stop()
+
+	var unanswered int32
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if int(atomic.AddInt32(&unanswered, 1)) > s.clientAliveCountMax {
+			l.Warnln("Client stopped answering keepalives, disconnecting")
+			conn.Close()
+			return
+		}
+
+		// Any reply counts, as clients answer requests they don't know with
+		// a failure.
+		go func() {
+			if _, _, err := conn.SendRequest("keepalive@openssh.com", true, nil); err == nil {
+				atomic.StoreInt32(&unanswered, 0)
+			}
+		}()
+	}
+}
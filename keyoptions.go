@@ -0,0 +1,95 @@
+package sshd
+
+import (
+	"strings"
+
+	"github.com/gliderlabs/ssh"
+	"github.com/inoc603/go-sshd/auth"
+)
+
+// contextKeyKeyOptions holds the options of the keys accepted during the
+// authentication, by key. Clients may query several keys before signing with
+// one, so the options are only known once the authentication is over.
+var contextKeyKeyOptions = &struct{ name string }{"key options"}
+
+// recordKeyOptions remembers the options of key, accepted for the client of
+// ctx.
+func recordKeyOptions(ctx ssh.Context, key ssh.PublicKey, opts *auth.KeyOptions) {
+	options, ok := ctx.Value(contextKeyKeyOptions).(map[string]*auth.KeyOptions)
+	if !ok {
+		options = make(map[string]*auth.KeyOptions)
+		ctx.SetValue(contextKeyKeyOptions, options)
+	}
+	options[string(key.Marshal())] = opts
+}
+
+// keyOptions returns the options of the key the client of ctx authenticated
+// with, or nil.
+func keyOptions(ctx ssh.Context) *auth.KeyOptions {
+	key, ok := ctx.Value(ssh.ContextKeyPublicKey).(ssh.PublicKey)
+	if !ok || key == nil {
+		return nil
+	}
+	options, _ := ctx.Value(contextKeyKeyOptions).(map[string]*auth.KeyOptions)
+	return options[string(key.Marshal())]
+}
+
+// applyKeyOptions restricts c with the options of the key the client
+// authenticated with. Like OpenSSH, a forced command of the server takes
+// precedence over the one of the key.
+func (c *connSettings) applyKeyOptions(o *auth.KeyOptions) {
+	if o == nil {
+		return
+	}
+	c.keyOptions = o
+
+	if c.forceCommand == "" {
+		c.forceCommand = o.Command
+	}
+	if o.NoPortForwarding {
+		c.localForwarding = nil
+		c.remoteForwarding = nil
+		c.streamLocalForwarding = nil
+	}
+	if o.NoAgentForwarding {
+		c.agentForwarding = false
+	}
+	if o.NoX11Forwarding {
+		c.x11Forwarding = false
+	}
+}
+
+// openAllowed reports whether the key allows local forwarding to port of
+// host, on top of the policy of the server.
+func (c *connSettings) openAllowed(host string, port uint32) bool {
+	return c.keyOptions == nil || c.keyOptions.OpenAllowed(host, port)
+}
+
+// listenAllowed reports whether the key allows remote forwarding from port of
+// host, on top of the policy of the server.
+func (c *connSettings) listenAllowed(host string, port uint32) bool {
+	return c.keyOptions == nil || c.keyOptions.ListenAllowed(host, port)
+}
+
+// allowPty reports whether the client of ctx may get a pty.
+func (s *Server) allowPty(ctx ssh.Context, pty ssh.Pty) bool {
+	o := s.settings(ctx).keyOptions
+	return o == nil || !o.NoPty
+}
+
+// keyEnvironment returns the variables set by the key of the client of ctx
+// which the server lets users set.
+func (s *Server) keyEnvironment(ctx ssh.Context) []string {
+	o := s.settings(ctx).keyOptions
+	if o == nil || len(s.permitUserEnvironment) == 0 {
+		return nil
+	}
+
+	var env []string
+	for _, kv := range o.Environment {
+		if name := kv[:strings.Index(kv, "=")]; matchAny(s.permitUserEnvironment, name) {
+			env = append(env, kv)
+		}
+	}
+	return env
+}
@@ -0,0 +1,180 @@
+package sshd
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/gliderlabs/ssh"
+	"github.com/pkg/errors"
+)
+
+// listenFdsStart is the first file descriptor passed by systemd.
+const listenFdsStart = 3
+
+// SystemdListeners returns the sockets passed by systemd socket activation,
+// in the order of the socket unit, or by the process which started this one
+// with Upgrade. It returns nothing if there are none. The variables describing
+// them are unset, so they aren't passed on to sessions.
+func SystemdListeners() ([]net.Listener, error) {
+	pid, parent, fds := os.Getenv("LISTEN_PID"), os.Getenv(envParentPID), os.Getenv("LISTEN_FDS")
+	if fds == "" {
+		return nil, nil
+	}
+	defer func() {
+		os.Unsetenv("LISTEN_PID")
+		os.Unsetenv("LISTEN_FDS")
+		os.Unsetenv("LISTEN_FDNAMES")
+		os.Unsetenv(envParentPID)
+	}()
+
+	upgraded := parent == strconv.Itoa(os.Getppid())
+	if pid != strconv.Itoa(os.Getpid()) && !upgraded {
+		return nil, nil
+	}
+
+	n, err := strconv.Atoi(fds)
+	if err != nil || n < 0 {
+		return nil, errors.Errorf("invalid LISTEN_FDS %q", fds)
+	}
+
+	var listeners []net.Listener
+	for fd := listenFdsStart; fd < listenFdsStart+n; fd++ {
+		f := os.NewFile(uintptr(fd), "LISTEN_FD_"+strconv.Itoa(fd))
+		// FileListener works on a duplicate, which is closed on exec.
+		l, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return nil, errors.Wrapf(err, "listen on file descriptor %d", fd)
+		}
+		// Unlike the sockets of systemd, the ones of an upgraded process
+		// are removed once it stops.
+		if ul, ok := l.(*net.UnixListener); ok && upgraded {
+			ul.SetUnlinkOnClose(true)
+		}
+		listeners = append(listeners, l)
+	}
+
+	return listeners, nil
+}
+
+// isUnixSocket reports whether addr is the path of a Unix socket rather than
+// a TCP address.
+func isUnixSocket(addr string) bool {
+	return strings.HasPrefix(addr, "/")
+}
+
+// listenUnix listens on the Unix socket at path, removing the socket left
+// behind by a server which didn't stop cleanly.
+func listenUnix(path string) (net.Listener, error) {
+	if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		if c, err := net.Dial("unix", path); err == nil {
+			c.Close()
+			return nil, errors.Errorf("listen unix %s: %s", path, syscall.EADDRINUSE)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, errors.Wrap(err, "remove stale socket")
+		}
+	}
+
+	return net.Listen("unix", path)
+}
+
+// listening reports whether one of listeners listens on addr already.
+func listening(listeners []net.Listener, addr string) bool {
+	for _, l := range listeners {
+		switch la := l.Addr().(type) {
+		case *net.UnixAddr:
+			if la.Name == addr {
+				return true
+			}
+		case *net.TCPAddr:
+			if isUnixSocket(addr) {
+				continue
+			}
+			ta, err := net.ResolveTCPAddr("tcp", addr)
+			if err != nil || ta.Port != la.Port {
+				continue
+			}
+			if ta.IP.Equal(la.IP) || (len(ta.IP) == 0 || ta.IP.IsUnspecified()) && la.IP.IsUnspecified() {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// listen opens the listeners of every address of the server, and adds the
+// listeners it was given. Addresses one of them listens on already are
+// skipped, as after an upgrade.
+func (s *Server) listen() ([]net.Listener, error) {
+	listeners := append([]net.Listener{}, s.listeners...)
+
+	for _, addr := range s.addrs {
+		if listening(s.listeners, addr) {
+			continue
+		}
+
+		var (
+			l   net.Listener
+			err error
+		)
+		if isUnixSocket(addr) {
+			l, err = listenUnix(addr)
+		} else {
+			l, err = net.Listen("tcp", addr)
+		}
+		if err != nil {
+			for _, l := range listeners[len(s.listeners):] {
+				l.Close()
+			}
+			return nil, err
+		}
+		listeners = append(listeners, l)
+	}
+
+	if len(listeners) == 0 {
+		return nil, errors.New("no address to listen on")
+	}
+
+	return listeners, nil
+}
+
+// serve serves the connections of every listener, and returns once none of
+// them is served anymore.
+func (s *Server) serve(srv *ssh.Server, listeners []net.Listener) error {
+	s.mu.Lock()
+	s.active = append(s.active, listeners...)
+	s.mu.Unlock()
+
+	errs := make([]error, len(listeners))
+
+	var wg sync.WaitGroup
+	for i, l := range listeners {
+		logrus.WithField("address", l.Addr().String()).Infoln("Listening")
+
+		wg.Add(1)
+		go func(i int, l net.Listener) {
+			defer wg.Done()
+			errs[i] = srv.Serve(l)
+			if errs[i] != ErrServerClosed {
+				logrus.WithField("address", l.Addr().String()).WithError(errs[i]).Errorln("Stopped listening")
+			}
+		}(i, l)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != ErrServerClosed {
+			return err
+		}
+	}
+	return ErrServerClosed
+}
@@ -0,0 +1,255 @@
+package sshd
+
+import (
+	"net"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/gliderlabs/ssh"
+	"github.com/inoc603/go-sshd/auth"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// Overrides are the settings a MatchRule changes. Nil fields are left as they
+// are. For policies and subsystems, nil leaves them as they are, while an
+// empty value disables them.
+type Overrides struct {
+	Record                *bool
+	LocalForwarding       ForwardPolicy
+	RemoteForwarding      ForwardPolicy
+	StreamLocalForwarding StreamLocalPolicy
+	AgentForwarding       *bool
+	X11Forwarding         *bool
+
+	// ForceCommand replaces the forced command, and an empty one removes it.
+	ForceCommand *string
+
+	// IdleTimeout disconnects clients which stay silent that long, and zero
+	// never does.
+	IdleTimeout *time.Duration
+
+	// Subsystems are the names of the subsystems the client may use.
+	Subsystems []string
+}
+
+// MatchRule overrides the settings of the connections matching all of its
+// criteria, once the client has authenticated. An empty criterion matches
+// everything.
+type MatchRule struct {
+	// Users and Groups are glob patterns of the names of the user and of
+	// their groups.
+	Users  []string
+	Groups []string
+
+	// Networks are matched against the address of the client.
+	Networks []*net.IPNet
+
+	// Methods are the authentication methods, publickey or password.
+	Methods []string
+
+	// Fingerprints are the SHA256 fingerprints of the public keys, like
+	// SHA256:+DiY3wvvV6TuJJhbpZisF/zLDA0zPMSvHdkr4UvCOqU.
+	Fingerprints []string
+
+	Overrides Overrides
+}
+
+// connSettings are the settings of a connection, once the match rules are
+// applied.
+type connSettings struct {
+	record                bool
+	localForwarding       ForwardPolicy
+	remoteForwarding      ForwardPolicy
+	streamLocalForwarding StreamLocalPolicy
+	agentForwarding       bool
+	x11Forwarding         bool
+	forceCommand          string
+	idleTimeout           time.Duration
+
+	// subsystems are the subsystems the client may use, all of them if nil.
+	subsystems []string
+
+	// keyOptions are the options of the key the client authenticated with.
+	keyOptions *auth.KeyOptions
+}
+
+var contextKeySettings = &struct{ name string }{"settings"}
+
+// settings returns the settings of the connection of ctx.
+func (s *Server) settings(ctx ssh.Context) *connSettings {
+	if c, ok := ctx.Value(contextKeySettings).(*connSettings); ok {
+		return c
+	}
+	return s.defaultSettings()
+}
+
+func (s *Server) defaultSettings() *connSettings {
+	return &connSettings{
+		record:                true,
+		localForwarding:       s.localForwarding,
+		remoteForwarding:      s.remoteForwarding,
+		streamLocalForwarding: s.streamLocalForwarding,
+		agentForwarding:       s.agentForwarding,
+		x11Forwarding:         s.x11Forwarding,
+		forceCommand:          s.forceCommand,
+		idleTimeout:           s.idleTimeout,
+	}
+}
+
+// authMethod returns the method the client of ctx authenticated with, and the
+// fingerprint of its key.
+func authMethod(ctx ssh.Context) (string, string) {
+	key, ok := ctx.Value(ssh.ContextKeyPublicKey).(ssh.PublicKey)
+	if !ok || key == nil {
+		return "password", ""
+	}
+	return "publickey", gossh.FingerprintSHA256(key)
+}
+
+// matches reports whether the connection of ctx, authenticated with method
+// and the key of fingerprint, matches the rule.
+func (r MatchRule) matches(ctx ssh.Context, method, fingerprint string, groups func() []string) bool {
+	if len(r.Users) > 0 && !matchAny(r.Users, ctx.User()) {
+		return false
+	}
+
+	if len(r.Methods) > 0 && !contains(r.Methods, method) {
+		return false
+	}
+	if len(r.Fingerprints) > 0 && !contains(r.Fingerprints, fingerprint) {
+		return false
+	}
+
+	if len(r.Networks) > 0 {
+		host, _ := hostPort(ctx.RemoteAddr())
+		ip := net.ParseIP(host)
+		found := false
+		for _, n := range r.Networks {
+			if ip != nil && n.Contains(ip) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	if len(r.Groups) > 0 {
+		found := false
+		for _, g := range groups() {
+			if matchAny(r.Groups, g) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	return true
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// apply sets the fields of c that o overrides, unless done says an earlier
+// rule already did.
+func (o Overrides) apply(c *connSettings, done map[string]bool) {
+	first := func(name string, set bool) bool {
+		if !set || done[name] {
+			return false
+		}
+		done[name] = true
+		return true
+	}
+
+	if first("record", o.Record != nil) {
+		c.record = *o.Record
+	}
+	if first("local_forwarding", o.LocalForwarding != nil) {
+		c.localForwarding = o.LocalForwarding
+	}
+	if first("remote_forwarding", o.RemoteForwarding != nil) {
+		c.remoteForwarding = o.RemoteForwarding
+	}
+	if first("streamlocal_forwarding", o.StreamLocalForwarding != nil) {
+		c.streamLocalForwarding = o.StreamLocalForwarding
+	}
+	if first("agent_forwarding", o.AgentForwarding != nil) {
+		c.agentForwarding = *o.AgentForwarding
+	}
+	if first("x11_forwarding", o.X11Forwarding != nil) {
+		c.x11Forwarding = *o.X11Forwarding
+	}
+	if first("force_command", o.ForceCommand != nil) {
+		c.forceCommand = *o.ForceCommand
+	}
+	if first("idle_timeout", o.IdleTimeout != nil) {
+		c.idleTimeout = *o.IdleTimeout
+	}
+	if first("subsystems", o.Subsystems != nil) {
+		c.subsystems = o.Subsystems
+	}
+}
+
+// matchSettings applies the rules matching the connection of ctx,
+// authenticated with method and the key of fingerprint, and returns the
+// settings along with the indices of the rules applied. Like OpenSSH's Match
+// blocks, the first matching rule setting a field decides its value.
+func (s *Server) matchSettings(ctx ssh.Context, method, fingerprint string) (*connSettings, []int) {
+	c := s.defaultSettings()
+
+	var groups []string
+	lookupGroups := func() []string {
+		if groups == nil {
+			groups = []string{}
+			if u, err := s.userStore.Get(ctx.User()); err == nil {
+				groups = groupNames(u)
+			}
+		}
+		return groups
+	}
+
+	var applied []int
+	done := make(map[string]bool)
+	for i, r := range s.matchRules {
+		if !r.matches(ctx, method, fingerprint, lookupGroups) {
+			continue
+		}
+		applied = append(applied, i)
+		r.Overrides.apply(c, done)
+	}
+
+	return c, applied
+}
+
+// handleConn sets up a connection once the client has authenticated.
+func (s *Server) handleConn(ctx ssh.Context, conn *gossh.ServerConn) {
+	method, fingerprint := authMethod(ctx)
+	c, applied := s.matchSettings(ctx, method, fingerprint)
+	for _, i := range applied {
+		logrus.WithFields(logrus.Fields{
+			"user":       ctx.User(),
+			"session_id": ctx.SessionID(),
+			"rule":       i,
+		}).Infoln("Match rule applied")
+	}
+	c.applyKeyOptions(keyOptions(ctx))
+	ctx.SetValue(contextKeySettings, c)
+	trackRemoteForwards(ctx)
+	if c.idleTimeout != s.idleTimeout {
+		ssh.SetIdleTimeout(ctx, c.idleTimeout)
+	}
+
+	if s.clientAliveInterval > 0 {
+		go s.keepAlive(ctx, conn)
+	}
+}
@@ -0,0 +1,7 @@
+package sshd
+
+import "expvar"
+
+// revokedKeyRejections counts the authentication attempts refused because the
+// key was revoked. It is published with expvar.
+var revokedKeyRejections = expvar.NewInt("sshd_revoked_key_rejections")
@@ -1,13 +1,28 @@
 package sshd
 
 import (
+	"net"
+	"time"
+
 	"github.com/inoc603/go-sshd/auth"
 	"github.com/pkg/errors"
 )
 
-func WithAddress(addr string) Option {
+// WithAddress sets the addresses the server listens on, :22 by default.
+// Addresses starting with / are the paths of Unix sockets. Without any
+// address, the server only serves the listeners given by WithListener.
+func WithAddress(addrs ...string) Option {
+	return func(s *Server) error {
+		s.addrs = addrs
+		return nil
+	}
+}
+
+// WithListener makes the server serve the connections accepted by listeners
+// too, like the sockets passed by systemd.
+func WithListener(listeners ...net.Listener) Option {
 	return func(s *Server) error {
-		s.addr = addr
+		s.listeners = append(s.listeners, listeners...)
 		return nil
 	}
 }
@@ -28,9 +43,11 @@ func WithAuth(a interface{}) Option {
 	}
 }
 
+// WithHostFile adds the private host key in file f. It can be given once for
+// every type of key.
 func WithHostFile(f string) Option {
 	return func(s *Server) error {
-		s.hostkeyFile = f
+		s.hostkeyFiles = append(s.hostkeyFiles, f)
 		return nil
 	}
 }
@@ -48,3 +65,217 @@ func WithRecorder(r RecorderFactory) Option {
 		return nil
 	}
 }
+
+// WithSubsystem serves the named subsystem, like sftp, with h.
+func WithSubsystem(name string, h SubsystemHandler) Option {
+	return func(s *Server) error {
+		s.subsystems[name] = h
+		return nil
+	}
+}
+
+// WithBuiltinSCP serves commands run by scp clients in-process, instead of
+// running the scp binary of the host.
+func WithBuiltinSCP() Option {
+	return func(s *Server) error {
+		s.builtinSCP = true
+		return nil
+	}
+}
+
+// WithLocalForwarding allows clients to open tunnels with ssh -L, to the
+// destinations allowed by policy.
+func WithLocalForwarding(policy ForwardPolicy) Option {
+	return func(s *Server) error {
+		if policy == nil {
+			policy = ForwardPolicy{}
+		}
+		s.localForwarding = policy
+		return nil
+	}
+}
+
+// WithRemoteForwarding allows clients to listen on the server with ssh -R, on
+// the addresses and ports allowed by policy. The policy is checked against the
+// bind address sent by the client, which is * when listening on all of them.
+func WithRemoteForwarding(policy ForwardPolicy) Option {
+	return func(s *Server) error {
+		if policy == nil {
+			policy = ForwardPolicy{}
+		}
+		s.remoteForwarding = policy
+		return nil
+	}
+}
+
+// WithStreamLocalForwarding allows clients to forward Unix sockets in both
+// directions, for the paths allowed by policy. Sockets are connected to and
+// created with the permissions of the user.
+func WithStreamLocalForwarding(policy StreamLocalPolicy) Option {
+	return func(s *Server) error {
+		if policy == nil {
+			policy = StreamLocalPolicy{}
+		}
+		s.streamLocalForwarding = policy
+		return nil
+	}
+}
+
+// WithAgentForwarding lets clients forward their agent into sessions with
+// ssh -A, except for users matching one of the glob patterns in disabledFor.
+func WithAgentForwarding(disabledFor ...string) Option {
+	return func(s *Server) error {
+		s.agentForwarding = true
+		s.noAgentUsers = disabledFor
+		return nil
+	}
+}
+
+// WithX11Forwarding lets clients forward X11 connections with ssh -X. xauth
+// must be installed to give programs in sessions access to the display.
+func WithX11Forwarding() Option {
+	return func(s *Server) error {
+		s.x11Forwarding = true
+		return nil
+	}
+}
+
+// WithAcceptEnv lets clients set the environment variables matching one of the
+// glob patterns, like LC_*. Other variables sent by clients are ignored.
+func WithAcceptEnv(patterns ...string) Option {
+	return func(s *Server) error {
+		s.acceptedEnv = append(s.acceptedEnv, patterns...)
+		return nil
+	}
+}
+
+// WithBanner sends text to clients before they authenticate.
+func WithBanner(text string) Option {
+	return func(s *Server) error {
+		s.banner = text
+		return nil
+	}
+}
+
+// WithPermitRootLogin sets how root may log in, which is like any other user
+// by default.
+func WithPermitRootLogin(r RootLogin) Option {
+	return func(s *Server) error {
+		s.permitRootLogin = r
+		return nil
+	}
+}
+
+// WithAllowUsers only lets the users matching one of the glob patterns log
+// in. Patterns like user@host also match the address of the client.
+func WithAllowUsers(patterns ...string) Option {
+	return func(s *Server) error {
+		s.allowUsers = append(s.allowUsers, patterns...)
+		return nil
+	}
+}
+
+// WithDenyUsers keeps the users matching one of the glob patterns from
+// logging in. Patterns like user@host also match the address of the client.
+func WithDenyUsers(patterns ...string) Option {
+	return func(s *Server) error {
+		s.denyUsers = append(s.denyUsers, patterns...)
+		return nil
+	}
+}
+
+// WithAllowGroups only lets the users in a group matching one of the glob
+// patterns log in.
+func WithAllowGroups(patterns ...string) Option {
+	return func(s *Server) error {
+		s.allowGroups = append(s.allowGroups, patterns...)
+		return nil
+	}
+}
+
+// WithDenyGroups keeps the users in a group matching one of the glob patterns
+// from logging in.
+func WithDenyGroups(patterns ...string) Option {
+	return func(s *Server) error {
+		s.denyGroups = append(s.denyGroups, patterns...)
+		return nil
+	}
+}
+
+// WithForceCommand runs command instead of whatever the client asks for, which
+// is passed on in SSH_ORIGINAL_COMMAND. A command of internal-sftp serves sftp
+// in-process.
+func WithForceCommand(command string) Option {
+	return func(s *Server) error {
+		s.forceCommand = command
+		return nil
+	}
+}
+
+// WithClientAlive checks clients are still there every interval, and
+// disconnects them after countMax checks in a row go unanswered.
+func WithClientAlive(interval time.Duration, countMax int) Option {
+	return func(s *Server) error {
+		if interval < 0 || countMax < 0 {
+			return errors.Errorf("invalid client alive settings %s, %d", interval, countMax)
+		}
+		s.clientAliveInterval = interval
+		s.clientAliveCountMax = countMax
+		return nil
+	}
+}
+
+// WithIdleTimeout disconnects clients which stay silent for d.
+func WithIdleTimeout(d time.Duration) Option {
+	return func(s *Server) error {
+		s.idleTimeout = d
+		return nil
+	}
+}
+
+// WithMatch adds rules overriding the settings of the connections they match,
+// checked in order once clients have authenticated.
+func WithMatch(rules ...MatchRule) Option {
+	return func(s *Server) error {
+		s.matchRules = append(s.matchRules, rules...)
+		return nil
+	}
+}
+
+// WithShutdownMessage sets the message Shutdown sends to the clients of
+// active sessions. An empty message sends nothing.
+func WithShutdownMessage(msg string) Option {
+	return func(s *Server) error {
+		s.shutdownMessage = msg
+		return nil
+	}
+}
+
+// WithRevokedKeys makes the server refuse the keys and certificates revoked by
+// r before any public key authentication method is tried.
+func WithRevokedKeys(r *auth.RevokedKeys) Option {
+	return func(s *Server) error {
+		s.revokedKeys = r
+		return nil
+	}
+}
+
+// WithAuthWatch makes the server check the files of its authentication
+// methods, like authorized keys files, for changes every interval, and reload
+// them when they change.
+func WithAuthWatch(interval time.Duration) Option {
+	return func(s *Server) error {
+		s.authWatch = interval
+		return nil
+	}
+}
+
+// WithPermitUserEnvironment lets the environment options of authorized keys
+// set the variables matching the glob patterns. They are ignored by default,
+// as they could get around restrictions like forced commands.
+func WithPermitUserEnvironment(patterns ...string) Option {
+	return func(s *Server) error {
+		s.permitUserEnvironment = patterns
+		return nil
+	}
+}
@@ -1,6 +1,12 @@
 package sshd
 
-import "github.com/gliderlabs/ssh"
+import (
+	"io"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/gliderlabs/ssh"
+)
 
 type RecorderFactory func(ssh.Session) (Recorder, error)
 
@@ -13,3 +19,62 @@ type DummyRecorder struct{}
 
 func (r *DummyRecorder) WriteInput(b []byte)  {}
 func (r *DummyRecorder) WriteOutput(b []byte) {}
+
+// Event is something that happens in a session other than terminal input and
+// output, like a file being transferred.
+type Event struct {
+	Time   time.Time
+	Type   string
+	Fields map[string]interface{}
+}
+
+// EventRecorder is implemented by recorders that also keep track of session
+// events.
+type EventRecorder interface {
+	WriteEvent(e Event)
+}
+
+// openRecorder is a recorder that has to be closed once its session is over.
+type openRecorder struct {
+	io.Closer
+}
+
+// recorder returns the recorder of session, which doesn't record anything if
+// recording is off for its connection. The returned function closes the
+// recorder, unless Close or Shutdown already did.
+func (s *Server) recorder(session ssh.Session) (Recorder, func(), error) {
+	if !s.settings(session.Context().(ssh.Context)).record {
+		return &DummyRecorder{}, func() {}, nil
+	}
+
+	rec, err := s.getRecorder(session)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	c, ok := rec.(io.Closer)
+	if !ok {
+		return rec, func() {}, nil
+	}
+
+	open := &openRecorder{c}
+	s.mu.Lock()
+	s.recorders[open] = struct{}{}
+	s.mu.Unlock()
+
+	return rec, func() { s.closeRecorder(open) }, nil
+}
+
+func (s *Server) closeRecorder(rec *openRecorder) {
+	s.mu.Lock()
+	_, ok := s.recorders[rec]
+	delete(s.recorders, rec)
+	s.mu.Unlock()
+
+	if !ok {
+		return
+	}
+	if err := rec.Close(); err != nil {
+		logrus.WithError(err).Warnln("Failed to close recorder")
+	}
+}
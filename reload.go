@@ -0,0 +1,57 @@
+package sshd
+
+import (
+	"context"
+
+	"github.com/inoc603/go-sshd/auth"
+	"github.com/pkg/errors"
+)
+
+// authMethods returns every authentication method of the server, along with
+// its revoked keys.
+func (s *Server) authMethods() []interface{} {
+	var methods []interface{}
+	if s.revokedKeys != nil {
+		methods = append(methods, s.revokedKeys)
+	}
+	for _, a := range s.pkAuth {
+		methods = append(methods, a)
+	}
+	for _, a := range s.pwAuth {
+		methods = append(methods, a)
+	}
+	return methods
+}
+
+// Reload reloads the authentication methods which support it, like the
+// authorized keys files. Every method is reloaded even if one of them fails,
+// keeping its previous configuration, and the first error is returned.
+func (s *Server) Reload() error {
+	var first error
+	for _, a := range s.authMethods() {
+		r, ok := a.(auth.Reloader)
+		if !ok {
+			continue
+		}
+		if err := r.Reload(); err != nil && first == nil {
+			first = errors.Wrap(err, "reload authentication")
+		}
+	}
+	return first
+}
+
+// watch starts watching the authentication methods which support it, until
+// the server stops.
+func (s *Server) watch() {
+	if s.authWatch <= 0 {
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	s.stopWatch = cancel
+	for _, a := range s.authMethods() {
+		if w, ok := a.(auth.Watcher); ok {
+			go w.Watch(ctx, s.authWatch)
+		}
+	}
+}
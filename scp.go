@@ -0,0 +1,43 @@
+package sshd
+
+import (
+	"github.com/gliderlabs/ssh"
+	"github.com/inoc603/go-sshd/auth"
+	"github.com/inoc603/go-sshd/fsuser"
+	"github.com/inoc603/go-sshd/scp"
+	"github.com/pkg/errors"
+)
+
+// serveSCP serves a command run by an scp client in-process, so no scp binary
+// is needed on the host. Files are accessed with the credentials of the user,
+// and relative paths start from the user's home directory.
+func (s *Server) serveSCP(session ssh.Session, user *auth.User) error {
+	rec, closeRecorder, err := s.recorder(session)
+	if err != nil {
+		return errors.Wrap(err, "failed to create recorder")
+	}
+	defer closeRecorder()
+
+	err = fsuser.Run(user, func() error {
+		return scp.Serve(session, session.Command()[1:],
+			scp.WorkDir(user.Home),
+			scp.OnEvent(func(e scp.Event) {
+				fields := map[string]interface{}{
+					"path":  e.Path,
+					"bytes": e.Bytes,
+				}
+				if e.Err != nil {
+					fields["error"] = e.Err.Error()
+				}
+				s.recordEvent(session.Context().(ssh.Context), rec, Event{Type: "scp." + e.Op, Fields: fields})
+			}),
+		)
+	})
+	if err == scp.ErrNotTransferred {
+		// Like the scp binary, just exit with 1 as the client already knows
+		// what went wrong.
+		return exitCode(1)
+	}
+
+	return err
+}
@@ -0,0 +1,15 @@
+//go:build !linux
+// +build !linux
+
+package scp
+
+import (
+	"os"
+	"time"
+)
+
+// accessTime returns the modification time of the file of fi, as the access
+// time is only read on Linux.
+func accessTime(fi os.FileInfo) time.Time {
+	return fi.ModTime()
+}
@@ -0,0 +1,302 @@
+// Package scp implements the remote side of the legacy scp protocol, which is
+// what the scp command runs as with -t (sink) or -f (source) on the server.
+package scp
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Event describes a file transferred by the client, or a failed attempt.
+type Event struct {
+	Op    string // upload or download
+	Path  string
+	Bytes int64
+	Err   error
+}
+
+// ErrNotTransferred is returned when some of the files couldn't be
+// transferred. The client has been told about each of them already.
+var ErrNotTransferred = errors.New("some files were not transferred")
+
+type Option func(s *server) error
+
+// WorkDir sets the directory relative paths are resolved against. It is the
+// root directory by default.
+func WorkDir(dir string) Option {
+	return func(s *server) error {
+		if !filepath.IsAbs(dir) {
+			return errors.Errorf("work directory %s is not absolute", dir)
+		}
+		s.workDir = filepath.Clean(dir)
+		return nil
+	}
+}
+
+// OnEvent sets a callback that is called for every file transferred.
+func OnEvent(fn func(e Event)) Option {
+	return func(s *server) error {
+		s.onEvent = fn
+		return nil
+	}
+}
+
+// IsCommand reports whether args is a command an scp client runs on the
+// server, like scp -t /tmp.
+func IsCommand(args []string) bool {
+	if len(args) == 0 || args[0] != "scp" {
+		return false
+	}
+	_, err := parseArgs(args[1:])
+	return err == nil
+}
+
+type flags struct {
+	recursive bool
+	preserve  bool
+	targetDir bool
+	sink      bool
+	source    bool
+	paths     []string
+}
+
+func parseArgs(args []string) (flags, error) {
+	var f flags
+
+	for i, arg := range args {
+		if arg == "--" {
+			f.paths = args[i+1:]
+			break
+		}
+		if !strings.HasPrefix(arg, "-") || arg == "-" {
+			f.paths = args[i:]
+			break
+		}
+		for _, c := range arg[1:] {
+			switch c {
+			case 'r':
+				f.recursive = true
+			case 'p':
+				f.preserve = true
+			case 'd':
+				f.targetDir = true
+			case 't':
+				f.sink = true
+			case 'f':
+				f.source = true
+			case 'v', 'q':
+			default:
+				return f, errors.Errorf("unknown option -%c", c)
+			}
+		}
+	}
+
+	if f.sink == f.source {
+		return f, errors.New("exactly one of -t and -f is required")
+	}
+	if len(f.paths) == 0 {
+		return f, errors.New("no path given")
+	}
+	if f.sink && len(f.paths) != 1 {
+		return f, errors.New("only one target is allowed with -t")
+	}
+
+	return f, nil
+}
+
+type server struct {
+	flags
+	workDir string
+	onEvent func(e Event)
+
+	r *bufio.Reader
+	w io.Writer
+
+	// failed is set when a file couldn't be transferred, which makes the
+	// command as a whole fail like scp does.
+	failed bool
+}
+
+// Serve runs the scp command given by args on rw, with args being what the
+// client wants to run without the leading scp. The files are accessed with
+// the credentials of the calling thread.
+func Serve(rw io.ReadWriter, args []string, opts ...Option) error {
+	f, err := parseArgs(args)
+	if err != nil {
+		return err
+	}
+
+	s := &server{
+		flags:   f,
+		workDir: "/",
+		onEvent: func(Event) {},
+		r:       bufio.NewReader(rw),
+		w:       rw,
+	}
+
+	for _, opt := range opts {
+		if err := opt(s); err != nil {
+			return err
+		}
+	}
+
+	if s.sink {
+		err = s.serveSink()
+	} else {
+		err = s.serveSource()
+	}
+	if err != nil {
+		return err
+	}
+
+	if s.failed {
+		return ErrNotTransferred
+	}
+
+	return nil
+}
+
+func (s *server) path(p string) string {
+	if !filepath.IsAbs(p) {
+		p = filepath.Join(s.workDir, p)
+	}
+	return filepath.Clean(p)
+}
+
+// ack tells the client the last message was handled.
+func (s *server) ack() error {
+	_, err := s.w.Write([]byte{0})
+	return err
+}
+
+// warn reports a problem with a single file to the client, which prints it and
+// carries on.
+func (s *server) warn(err error) error {
+	s.failed = true
+	_, werr := fmt.Fprintf(s.w, "\x01scp: %s\n", err)
+	return werr
+}
+
+// fatal reports an error to the client, which aborts the transfer.
+func (s *server) fatal(err error) error {
+	fmt.Fprintf(s.w, "\x02scp: %s\n", err)
+	return err
+}
+
+// clientError is a problem reported by the client. Unless it's fatal, the
+// client carries on with the next file.
+type clientError struct {
+	msg   string
+	fatal bool
+}
+
+func (e *clientError) Error() string {
+	return e.msg
+}
+
+func isFatal(err error) bool {
+	ce, ok := err.(*clientError)
+	return !ok || ce.fatal
+}
+
+// readAck waits for the client to confirm the last message. Problems reported
+// by the client are returned as a *clientError.
+func (s *server) readAck() error {
+	c, err := s.r.ReadByte()
+	if err != nil {
+		return errors.Wrap(err, "read response")
+	}
+	if c == 0 {
+		return nil
+	}
+	if c != 1 && c != 2 {
+		return errors.Errorf("unexpected response %q", c)
+	}
+
+	msg, err := s.r.ReadString('\n')
+	if err != nil {
+		return errors.Wrap(err, "read response")
+	}
+	return &clientError{strings.TrimSuffix(msg, "\n"), c == 2}
+}
+
+// fileTimes converts the times of a T message.
+type fileTimes struct {
+	mtime time.Time
+	atime time.Time
+}
+
+func parseTimes(line string) (*fileTimes, error) {
+	var mtime, mtimeUsec, atime, atimeUsec int64
+	if _, err := fmt.Sscanf(line, "%d %d %d %d", &mtime, &mtimeUsec, &atime, &atimeUsec); err != nil {
+		return nil, errors.Errorf("invalid times %q", line)
+	}
+
+	return &fileTimes{
+		mtime: time.Unix(mtime, mtimeUsec*1000),
+		atime: time.Unix(atime, atimeUsec*1000),
+	}, nil
+}
+
+// parseEntry parses the mode, size and name of a C or D message.
+func parseEntry(line string) (uint32, int64, string, error) {
+	parts := strings.SplitN(line, " ", 3)
+	if len(parts) != 3 {
+		return 0, 0, "", errors.Errorf("invalid entry %q", line)
+	}
+
+	mode, err := strconv.ParseUint(parts[0], 8, 32)
+	if err != nil {
+		return 0, 0, "", errors.Errorf("invalid mode %q", parts[0])
+	}
+
+	size, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil || size < 0 {
+		return 0, 0, "", errors.Errorf("invalid size %q", parts[1])
+	}
+
+	name := parts[2]
+	if name == "" || name == "." || name == ".." || strings.Contains(name, "/") {
+		return 0, 0, "", errors.Errorf("invalid file name %q", name)
+	}
+
+	return uint32(mode) & 07777, size, name, nil
+}
+
+// fileMode converts the permission bits sent by the client.
+func fileMode(m uint32) os.FileMode {
+	mode := os.FileMode(m & 0777)
+	if m&04000 != 0 {
+		mode |= os.ModeSetuid
+	}
+	if m&02000 != 0 {
+		mode |= os.ModeSetgid
+	}
+	if m&01000 != 0 {
+		mode |= os.ModeSticky
+	}
+	return mode
+}
+
+// scpMode converts a mode to the permission bits sent to the client.
+func scpMode(m os.FileMode) uint32 {
+	mode := uint32(m.Perm())
+	if m&os.ModeSetuid != 0 {
+		mode |= 04000
+	}
+	if m&os.ModeSetgid != 0 {
+		mode |= 02000
+	}
+	if m&os.ModeSticky != 0 {
+		mode |= 01000
+	}
+	return mode
+}
@@ -0,0 +1,201 @@
+package scp
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// dir is a directory being received.
+type dir struct {
+	path  string
+	times *fileTimes
+}
+
+// serveSink receives files from the client, for scp -t.
+func (s *server) serveSink() error {
+	target := s.path(s.paths[0])
+	fi, err := os.Stat(target)
+	targetIsDir := err == nil && fi.IsDir()
+	if s.targetDir && !targetIsDir {
+		return s.fatal(errors.Errorf("%s: Not a directory", target))
+	}
+
+	// dest returns where an entry sent by the client goes. Like scp, the target
+	// itself is used if it isn't a directory.
+	var dirs []dir
+	dest := func(name string) string {
+		switch {
+		case len(dirs) > 0:
+			return filepath.Join(dirs[len(dirs)-1].path, name)
+		case targetIsDir:
+			return filepath.Join(target, name)
+		default:
+			return target
+		}
+	}
+
+	if err := s.ack(); err != nil {
+		return err
+	}
+
+	var times *fileTimes
+	for {
+		c, err := s.r.ReadByte()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return errors.Wrap(err, "read message")
+		}
+
+		line, err := s.r.ReadString('\n')
+		if err != nil {
+			return errors.Wrap(err, "read message")
+		}
+		line = strings.TrimSuffix(line, "\n")
+
+		switch c {
+		case '\x01':
+			// The client failed to send a file and tells us about it.
+			s.failed = true
+		case '\x02':
+			return errors.New(line)
+		case 'T':
+			if times, err = parseTimes(line); err != nil {
+				return s.fatal(err)
+			}
+			if err := s.ack(); err != nil {
+				return err
+			}
+		case 'C':
+			mode, size, name, err := parseEntry(line)
+			if err != nil {
+				return s.fatal(err)
+			}
+			if err := s.receiveFile(dest(name), mode, size, times); err != nil {
+				return err
+			}
+			times = nil
+		case 'D':
+			if !s.recursive {
+				return s.fatal(errors.New("received directory without -r"))
+			}
+			mode, _, name, err := parseEntry(line)
+			if err != nil {
+				return s.fatal(err)
+			}
+			path := dest(name)
+			if err := s.makeDir(path, mode); err != nil {
+				return s.fatal(err)
+			}
+			dirs = append(dirs, dir{path, times})
+			times = nil
+			if err := s.ack(); err != nil {
+				return err
+			}
+		case 'E':
+			if len(dirs) == 0 {
+				return s.fatal(errors.New("unexpected end of directory"))
+			}
+			d := dirs[len(dirs)-1]
+			dirs = dirs[:len(dirs)-1]
+			if s.preserve && d.times != nil {
+				os.Chtimes(d.path, d.times.atime, d.times.mtime)
+			}
+			if err := s.ack(); err != nil {
+				return err
+			}
+		default:
+			return s.fatal(errors.Errorf("unexpected message %q", string(c)+line))
+		}
+	}
+}
+
+func (s *server) makeDir(path string, mode uint32) error {
+	fi, err := os.Stat(path)
+	if err == nil {
+		if !fi.IsDir() {
+			return errors.Errorf("%s: Not a directory", path)
+		}
+		if s.preserve {
+			return os.Chmod(path, fileMode(mode))
+		}
+		return nil
+	}
+
+	// Make sure the directory is writable while files are put into it.
+	if err := os.Mkdir(path, fileMode(mode)|0700); err != nil {
+		return err
+	}
+	if s.preserve {
+		return os.Chmod(path, fileMode(mode))
+	}
+	return nil
+}
+
+// fileWriter writes to a file until the first error, and discards everything
+// after that. It never fails so that the content sent by the client is always
+// consumed, keeping the stream in sync.
+type fileWriter struct {
+	f   *os.File
+	err error
+}
+
+func (w *fileWriter) Write(b []byte) (int, error) {
+	if w.err == nil {
+		_, w.err = w.f.Write(b)
+	}
+	return len(b), nil
+}
+
+// receiveFile writes the content of a file sent by the client to path.
+func (s *server) receiveFile(path string, mode uint32, size int64, times *fileTimes) error {
+	if err := s.ack(); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE, fileMode(mode))
+	w := &fileWriter{f, err}
+	if _, err := io.CopyN(w, s.r, size); err != nil {
+		if f != nil {
+			f.Close()
+		}
+		return errors.Wrap(err, "read file content")
+	}
+
+	if f != nil {
+		if w.err == nil {
+			w.err = f.Truncate(size)
+		}
+		if w.err == nil && s.preserve {
+			w.err = f.Chmod(fileMode(mode))
+		}
+		if err := f.Close(); w.err == nil {
+			w.err = err
+		}
+		if w.err == nil && s.preserve && times != nil {
+			w.err = os.Chtimes(path, times.atime, times.mtime)
+		}
+	}
+
+	// The client tells whether it managed to send the whole file.
+	if err := s.readAck(); err != nil {
+		if isFatal(err) {
+			return err
+		}
+		if w.err == nil {
+			w.err = err
+		}
+	}
+
+	s.onEvent(Event{Op: "upload", Path: path, Bytes: size, Err: w.err})
+	if w.err != nil {
+		return s.warn(w.err)
+	}
+
+	return s.ack()
+}
@@ -0,0 +1,172 @@
+package scp
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// serveSource sends files to the client, for scp -f.
+func (s *server) serveSource() error {
+	// Wait for the client to be ready.
+	if err := s.readAck(); err != nil {
+		return err
+	}
+
+	for _, p := range s.paths {
+		path := s.path(p)
+
+		// The shell expands wildcards in the path of a real scp.
+		matches := []string{path}
+		if strings.ContainsAny(path, "*?[") {
+			matches, _ = filepath.Glob(path)
+			if len(matches) == 0 {
+				if err := s.warn(errors.Errorf("%s: No such file or directory", path)); err != nil {
+					return err
+				}
+			}
+		}
+
+		for _, m := range matches {
+			if err := s.send(m); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func (s *server) send(path string) error {
+	fi, err := os.Stat(path)
+	if err != nil {
+		s.onEvent(Event{Op: "download", Path: path, Err: err})
+		return s.warn(err)
+	}
+
+	switch {
+	case fi.IsDir() && s.recursive:
+		return s.sendDir(path, fi)
+	case fi.Mode().IsRegular():
+		return s.sendFile(path, fi)
+	default:
+		return s.warn(errors.Errorf("%s: not a regular file", path))
+	}
+}
+
+// sendMessage sends a message and waits for the client to accept it. Warnings
+// from the client are returned as well, after which the current file is
+// skipped.
+func (s *server) sendMessage(format string, args ...interface{}) error {
+	if _, err := fmt.Fprintf(s.w, format, args...); err != nil {
+		return err
+	}
+	return s.readAck()
+}
+
+func (s *server) sendTimes(fi os.FileInfo) error {
+	if !s.preserve {
+		return nil
+	}
+
+	mtime := fi.ModTime().Unix()
+	atime := accessTime(fi).Unix()
+	return s.sendMessage("T%d 0 %d 0\n", mtime, atime)
+}
+
+// skip returns nil if err is just a warning from the client, in which case the
+// current file is skipped.
+func (s *server) skip(err error) error {
+	if isFatal(err) {
+		return err
+	}
+	s.failed = true
+	return nil
+}
+
+func (s *server) sendFile(path string, fi os.FileInfo) error {
+	f, err := os.Open(path)
+	if err != nil {
+		s.onEvent(Event{Op: "download", Path: path, Err: err})
+		return s.warn(err)
+	}
+	defer f.Close()
+
+	if err := s.sendTimes(fi); err != nil {
+		return s.skip(err)
+	}
+
+	size := fi.Size()
+	if err := s.sendMessage("C%04o %d %s\n", scpMode(fi.Mode()), size, fi.Name()); err != nil {
+		return s.skip(err)
+	}
+
+	// Once the size is announced, that much has to be sent even if reading the
+	// file fails.
+	n, rerr := io.CopyN(s.w, f, size)
+	if rerr != nil {
+		if _, ok := rerr.(*os.PathError); !ok && rerr != io.EOF {
+			return errors.Wrap(rerr, "send file content")
+		}
+		if _, err := io.CopyN(s.w, zeros{}, size-n); err != nil {
+			return errors.Wrap(err, "send file content")
+		}
+	}
+
+	s.onEvent(Event{Op: "download", Path: path, Bytes: n, Err: rerr})
+	if rerr != nil {
+		if err := s.warn(rerr); err != nil {
+			return err
+		}
+	} else if err := s.ack(); err != nil {
+		return err
+	}
+
+	if err := s.readAck(); err != nil {
+		return s.skip(err)
+	}
+
+	return nil
+}
+
+func (s *server) sendDir(path string, fi os.FileInfo) error {
+	entries, err := ioutil.ReadDir(path)
+	if err != nil {
+		return s.warn(err)
+	}
+
+	if err := s.sendTimes(fi); err != nil {
+		return s.skip(err)
+	}
+
+	if err := s.sendMessage("D%04o 0 %s\n", scpMode(fi.Mode()), fi.Name()); err != nil {
+		return s.skip(err)
+	}
+
+	for _, e := range entries {
+		if err := s.send(filepath.Join(path, e.Name())); err != nil {
+			return err
+		}
+	}
+
+	if err := s.sendMessage("E\n"); err != nil {
+		return s.skip(err)
+	}
+
+	return nil
+}
+
+// zeros pads a file which got shorter while it was sent.
+type zeros struct{}
+
+func (zeros) Read(b []byte) (int, error) {
+	for i := range b {
+		b[i] = 0
+	}
+	return len(b), nil
+}
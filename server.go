@@ -1,39 +1,94 @@
 package sshd
 
 import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
 	"fmt"
 	"io"
+	"net"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"sync"
 	"syscall"
+	"time"
 	"unsafe"
 
 	"github.com/Sirupsen/logrus"
 	"github.com/gliderlabs/ssh"
 	"github.com/inoc603/go-sshd/auth"
+	"github.com/inoc603/go-sshd/fsuser"
 	"github.com/inoc603/go-sshd/pipe"
+	"github.com/inoc603/go-sshd/scp"
 	"github.com/kr/pty"
 	"github.com/pkg/errors"
+	gossh "golang.org/x/crypto/ssh"
 )
 
 type Option func(s *Server) error
 
 type Server struct {
-	addr        string
-	hostkeyFile string
-	userStore   auth.UserStore
-	pkAuth      []auth.PublicKeyAuth
-	pwAuth      []auth.PasswordAuth
-	getRecorder RecorderFactory
+	addrs        []string
+	listeners    []net.Listener
+	hostkeyFiles []string
+	userStore    auth.UserStore
+	pkAuth       []auth.PublicKeyAuth
+	pwAuth       []auth.PasswordAuth
+	revokedKeys  *auth.RevokedKeys
+	getRecorder  RecorderFactory
+	subsystems   map[string]SubsystemHandler
+	builtinSCP   bool
+
+	localForwarding       ForwardPolicy
+	remoteForwarding      ForwardPolicy
+	streamLocalForwarding StreamLocalPolicy
+
+	acceptedEnv           []string
+	permitUserEnvironment []string
+
+	agentForwarding bool
+	noAgentUsers    []string
+	x11Forwarding   bool
+
+	banner          string
+	permitRootLogin RootLogin
+	allowUsers      []string
+	denyUsers       []string
+	allowGroups     []string
+	denyGroups      []string
+	forceCommand    string
+
+	clientAliveInterval time.Duration
+	clientAliveCountMax int
+	idleTimeout         time.Duration
+
+	matchRules []MatchRule
+
+	shutdownMessage string
+
+	authWatch time.Duration
+	stopWatch context.CancelFunc
+
+	mu        sync.Mutex
+	srv       *ssh.Server
+	active    []net.Listener
+	sessions  map[ssh.Session]struct{}
+	recorders map[*openRecorder]struct{}
 }
 
 func NewServer(opts ...Option) (*Server, error) {
 	s := &Server{
-		addr:      ":22",
+		addrs:     []string{":22"},
 		userStore: &auth.DummyUserStore{},
 		getRecorder: func(ssh.Session) (Recorder, error) {
 			return &DummyRecorder{}, nil
 		},
+		subsystems:          make(map[string]SubsystemHandler),
+		clientAliveCountMax: 3,
+		shutdownMessage:     "The server is shutting down.",
+		sessions:            make(map[ssh.Session]struct{}),
+		recorders:           make(map[*openRecorder]struct{}),
 	}
 
 	for _, opt := range opts {
@@ -46,15 +101,43 @@ func NewServer(opts ...Option) (*Server, error) {
 }
 
 func (s *Server) authPublicKey(ctx ssh.Context, key ssh.PublicKey) bool {
+	if s.revokedKeys != nil && s.revokedKeys.IsRevoked(key) {
+		revokedKeyRejections.Add(1)
+		logrus.WithFields(logrus.Fields{
+			"user":        ctx.User(),
+			"session_id":  ctx.SessionID(),
+			"fingerprint": gossh.FingerprintSHA256(key),
+		}).Warnln("Refused revoked key")
+		return false
+	}
+
 	for _, a := range s.pkAuth {
-		if a.Auth(ctx, key) {
-			return true
+		var (
+			opts *auth.KeyOptions
+			ok   bool
+		)
+		if oa, isOptionsAuth := a.(auth.KeyOptionsAuth); isOptionsAuth {
+			opts, ok = oa.AuthOptions(ctx, key)
+		} else {
+			ok = a.Auth(ctx, key)
 		}
+		if !ok {
+			continue
+		}
+
+		if !s.allowed(ctx, "publickey", gossh.FingerprintSHA256(key), opts != nil && opts.Command != "") {
+			return false
+		}
+		recordKeyOptions(ctx, key, opts)
+		return true
 	}
 	return false
 }
 
 func (s *Server) authPassword(ctx ssh.Context, password string) bool {
+	if !s.allowed(ctx, "password", "", false) {
+		return false
+	}
 	for _, a := range s.pwAuth {
 		if a.Auth(ctx, password) {
 			return true
@@ -63,19 +146,118 @@ func (s *Server) authPassword(ctx ssh.Context, password string) bool {
 	return false
 }
 
+// server returns the underlying ssh server, creating it the first time.
+func (s *Server) server() (*ssh.Server, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.srv != nil {
+		return s.srv, nil
+	}
+
+	srv := &ssh.Server{
+		Handler: s.track(s.handleSSH),
+	}
+
+	// Public key authentication is always set up, as the server would let
+	// anyone in without any method.
+	opts := []ssh.Option{ssh.PublicKeyAuth(s.authPublicKey)}
+	if len(s.pwAuth) > 0 {
+		opts = append(opts, ssh.PasswordAuth(s.authPassword))
+	}
+
+	for _, f := range s.hostkeyFiles {
+		opts = append(opts, ssh.HostKeyFile(f))
+	}
+
+	opts = append(opts, s.configure)
+
+	for _, opt := range opts {
+		if err := srv.SetOption(opt); err != nil {
+			return nil, err
+		}
+	}
+
+	// Serve generates a host key when there is none, unsynchronized, so it
+	// is done once here rather than by every listener.
+	if len(srv.HostSigners) == 0 {
+		key, err := rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			return nil, errors.Wrap(err, "generate host key")
+		}
+		signer, err := gossh.NewSignerFromKey(key)
+		if err != nil {
+			return nil, errors.Wrap(err, "generate host key")
+		}
+		srv.AddHostKey(signer)
+	}
+
+	s.srv = srv
+	s.watch()
+	return srv, nil
+}
+
+// Start listens on the addresses of the server and serves the connections it
+// accepts on them and on the listeners it was given. It returns
+// ErrServerClosed once the server is closed or shut down.
 func (s *Server) Start() error {
-	var opts []ssh.Option
+	srv, err := s.server()
+	if err != nil {
+		return err
+	}
+
+	listeners, err := s.listen()
+	if err != nil {
+		return err
+	}
+	notifyReady()
+	return s.serve(srv, listeners)
+}
+
+// Serve serves the connections accepted by l, which is closed when Serve
+// returns. It returns ErrServerClosed once the server is closed or shut down.
+func (s *Server) Serve(l net.Listener) error {
+	srv, err := s.server()
+	if err != nil {
+		l.Close()
+		return err
+	}
+	return s.serve(srv, []net.Listener{l})
+}
+
+// configure sets up the handlers of the underlying ssh server for the enabled
+// features.
+func (s *Server) configure(srv *ssh.Server) error {
+	srv.Banner = s.banner
 
-	opts = append(opts,
-		ssh.PublicKeyAuth(s.authPublicKey),
-		ssh.PasswordAuth(s.authPassword),
-	)
+	srv.SubsystemHandlers = make(map[string]ssh.SubsystemHandler)
+	for name, h := range s.subsystems {
+		srv.SubsystemHandlers[name] = ssh.SubsystemHandler(s.track(ssh.Handler(s.handleSubsystem(h))))
+	}
+
+	// The handlers of every feature are set up, as match rules may enable
+	// them for some connections only. They check the settings of the
+	// connection themselves.
+	srv.ChannelHandlers = map[string]ssh.ChannelHandler{
+		"session":                        ssh.DefaultSessionHandler,
+		"direct-tcpip":                   s.handleDirectTCPIP,
+		"direct-streamlocal@openssh.com": s.handleDirectStreamLocal,
+	}
+
+	srv.X11Callback = s.allowX11
+	srv.PtyCallback = s.allowPty
 
-	if s.hostkeyFile != "" {
-		opts = append(opts, ssh.HostKeyFile(s.hostkeyFile))
+	srv.RequestHandlers = map[string]ssh.RequestHandler{
+		"tcpip-forward":                          s.handleTCPIPForward,
+		"cancel-tcpip-forward":                   s.handleCancelTCPIPForward,
+		"streamlocal-forward@openssh.com":        s.handleStreamLocalForward,
+		"cancel-streamlocal-forward@openssh.com": s.handleCancelStreamLocalForward,
 	}
 
-	return ssh.ListenAndServe(s.addr, s.handleSSH, opts...)
+	srv.IdleTimeout = s.idleTimeout
+	srv.ConnHandler = s.handleConn
+
+	return nil
 }
 
 func setWinsize(f *os.File, w, h int) {
@@ -83,19 +265,38 @@ func setWinsize(f *os.File, w, h int) {
 		uintptr(unsafe.Pointer(&struct{ h, w, x, y uint16 }{uint16(h), uint16(w), 0, 0})))
 }
 
-func (s *Server) startCommand(cmd *exec.Cmd, session ssh.Session) error {
-	ptyReq, winCh, isPty := session.Pty()
-	if !isPty {
-		return errors.Errorf("no pty requested")
-	}
+// recordWriter hands everything written through it to record before passing
+// it on to the underlying writer.
+type recordWriter struct {
+	io.Writer
+	record func(b []byte)
+}
 
-	rec, err := s.getRecorder(session)
+func (w recordWriter) Write(b []byte) (int, error) {
+	w.record(b)
+	return w.Writer.Write(b)
+}
+
+func (s *Server) startPty(cmd *exec.Cmd, session ssh.Session, rec Recorder) error {
+	_, winCh, _ := session.Pty()
+
+	// Open the pty instead of using pty.Start, as SSH_TTY needs the name of
+	// the tty before the command starts.
+	f, tty, err := pty.Open()
 	if err != nil {
-		return errors.Wrap(err, "failed to create recorder")
+		return errors.Wrap(err, "open pty")
 	}
+	defer f.Close()
 
-	cmd.Env = append(os.Environ(), fmt.Sprintf("TERM=%s", ptyReq.Term))
-	f, err := pty.Start(cmd)
+	cmd.Env = setenv(cmd.Env, "SSH_TTY", tty.Name())
+	cmd.Stdin = tty
+	cmd.Stdout = tty
+	cmd.Stderr = tty
+	cmd.SysProcAttr.Setsid = true
+	cmd.SysProcAttr.Setctty = true
+
+	err = cmd.Start()
+	tty.Close()
 	if err != nil {
 		return errors.Wrap(err, "start pty")
 	}
@@ -114,7 +315,73 @@ func (s *Server) startCommand(cmd *exec.Cmd, session ssh.Session) error {
 	go io.Copy(session, stdout.Reader())
 	go io.Copy(stdout.Writer(), f)
 
-	return cmd.Wait()
+	return wait(cmd, session)
+}
+
+func (s *Server) startExec(cmd *exec.Cmd, session ssh.Session, rec Recorder) error {
+	// Like OpenSSH, start a new session even without a pty, which also puts
+	// the command in its own process group.
+	cmd.SysProcAttr.Setsid = true
+	cmd.Stdout = recordWriter{session, rec.WriteOutput}
+	cmd.Stderr = recordWriter{session.Stderr(), rec.WriteOutput}
+
+	// Use a pipe instead of assigning the session to cmd.Stdin, otherwise Wait
+	// would block until the client closes its side even after the process has
+	// exited.
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return errors.Wrap(err, "create stdin pipe")
+	}
+
+	if err := cmd.Start(); err != nil {
+		return errors.Wrap(err, "start command")
+	}
+
+	go func() {
+		io.Copy(recordWriter{stdin, rec.WriteInput}, session)
+		stdin.Close()
+	}()
+
+	return wait(cmd, session)
+}
+
+func (s *Server) startCommand(cmd *exec.Cmd, session ssh.Session) error {
+	rec, closeRecorder, err := s.recorder(session)
+	if err != nil {
+		return errors.Wrap(err, "failed to create recorder")
+	}
+	defer closeRecorder()
+
+	if _, _, isPty := session.Pty(); isPty {
+		return s.startPty(cmd, session, rec)
+	}
+
+	return s.startExec(cmd, session, rec)
+}
+
+// credential returns the credentials to run the commands of user with.
+func credential(user *auth.User) *syscall.Credential {
+	return &syscall.Credential{
+		Uid:    user.UID,
+		Gid:    user.GID,
+		Groups: user.GroupIDs(),
+	}
+}
+
+// checkHome checks user can change into their home directory, which the
+// process starting a command only does after switching to the user.
+func checkHome(user *auth.User) error {
+	return fsuser.Run(user, func() error {
+		// Looking up . makes sure the directory is searchable.
+		fi, err := os.Stat(user.Home + "/.")
+		if err != nil {
+			return err
+		}
+		if !fi.IsDir() {
+			return errors.Errorf("%s is not a directory", user.Home)
+		}
+		return nil
+	})
 }
 
 func (s *Server) handleSession(session ssh.Session) error {
@@ -127,30 +394,148 @@ func (s *Server) handleSession(session ssh.Session) error {
 	logrus.WithFields(logrus.Fields{
 		"user":       session.User(),
 		"shell":      user.Shell,
+		"command":    session.RawCommand(),
 		"session_id": session.Context().(ssh.Context).SessionID(),
 	}).Infoln("Session started")
 
+	// A forced command replaces whatever the client asked for, which is
+	// passed on in SSH_ORIGINAL_COMMAND.
+	command, original := session.RawCommand(), ""
+	if forced := s.settings(session.Context().(ssh.Context)).forceCommand; forced != "" {
+		command, original = forced, command
+		if session.Subsystem() != "" {
+			original = session.Subsystem()
+		}
+		if command == "internal-sftp" {
+			return errors.Wrap(s.serveSubsystem(session, ServeSFTP), "sftp")
+		}
+	} else if s.builtinSCP && scp.IsCommand(session.Command()) {
+		return errors.Wrap(s.serveSCP(session, user), "scp")
+	}
+
+	// Like OpenSSH, hand the command string to the user's shell as is, so the
+	// quoting and expansion the client expects still work. Without a command,
+	// the shell is told to act as a login shell by a leading dash in argv[0].
 	cmd := exec.Command(shell)
+	if command != "" {
+		cmd.Args = []string{filepath.Base(shell), "-c", command}
+	} else {
+		cmd.Args = []string{"-" + filepath.Base(shell)}
+	}
+	cmd.Env = s.environ(session, user)
+	if original != "" {
+		cmd.Env = setenv(cmd.Env, "SSH_ORIGINAL_COMMAND", original)
+	}
+	cmd.Dir = user.Home
+	if err := checkHome(user); err != nil {
+		logrus.WithFields(logrus.Fields{
+			"user":       session.User(),
+			"session_id": session.Context().(ssh.Context).SessionID(),
+		}).WithError(err).Warnln("Starting in / instead of the home directory")
+		reason := errors.Cause(err)
+		if pathErr, ok := reason.(*os.PathError); ok {
+			reason = pathErr.Err
+		}
+		fmt.Fprintf(session.Stderr(), "Could not chdir to home directory %s: %s\n", user.Home, reason)
+		cmd.Dir = "/"
+	}
 	cmd.SysProcAttr = &syscall.SysProcAttr{
-		Credential: &syscall.Credential{
-			Uid: user.UID,
-			Gid: user.GID,
-		},
+		Credential: credential(user),
+	}
+
+	if ssh.AgentRequested(session) && s.agentAllowed(session.Context().(ssh.Context)) {
+		sock, cleanup, err := s.forwardAgent(session, user)
+		if err != nil {
+			return err
+		}
+		defer cleanup()
+		cmd.Env = setenv(cmd.Env, "SSH_AUTH_SOCK", sock)
 	}
-	cmd.Args = []string{
-		shell,
+
+	if x11, ok := session.X11(); ok {
+		display, cleanup, err := s.forwardX11(session, user, x11)
+		if err != nil {
+			return err
+		}
+		defer cleanup()
+		cmd.Env = setenv(cmd.Env, "DISPLAY", display)
+		cmd.Env = setenv(cmd.Env, "XAUTHORITY", xauthority(user))
 	}
 
 	return errors.Wrap(s.startCommand(cmd, session), "running command")
 }
 
+// recordEvent logs e and passes it to the recorder, if there is one and it
+// keeps track of events.
+func (s *Server) recordEvent(ctx ssh.Context, rec Recorder, e Event) {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"user":       ctx.User(),
+		"session_id": ctx.SessionID(),
+		"event":      e.Type,
+	}).WithFields(e.Fields).Infoln("Session event")
+
+	if er, ok := rec.(EventRecorder); ok {
+		er.WriteEvent(e)
+	}
+}
+
+// exitCode is returned by commands served in-process which failed after
+// telling the client why.
+type exitCode int
+
+func (c exitCode) Error() string {
+	return fmt.Sprintf("exit status %d", int(c))
+}
+
+// exitStatus returns the exit status of the process if err is caused by the
+// process exiting with a non-zero status.
+func exitStatus(err error) (int, bool) {
+	if code, ok := errors.Cause(err).(exitCode); ok {
+		return int(code), true
+	}
+
+	exitErr, ok := errors.Cause(err).(*exec.ExitError)
+	if !ok {
+		return 0, false
+	}
+
+	status, ok := exitErr.Sys().(syscall.WaitStatus)
+	if !ok || !status.Exited() {
+		return 0, false
+	}
+
+	return status.ExitStatus(), true
+}
+
 func (s *Server) handleSSH(session ssh.Session) {
 	l := logrus.WithFields(logrus.Fields{
 		"user":       session.User(),
 		"session_id": session.Context().(ssh.Context).SessionID(),
 	})
-	if err := s.handleSession(session); err != nil {
-		io.WriteString(session, err.Error()+"\n")
+	err := s.handleSession(session)
+	if code, ok := exitStatus(err); ok {
+		l.WithField("status", code).Infoln("Session ended")
+		session.Exit(code)
+		return
+	}
+
+	if sig, coreDumped, ok := exitSignal(err); ok {
+		l.WithFields(logrus.Fields{
+			"signal":      signalName(sig),
+			"core_dumped": coreDumped,
+		}).Infoln("Session ended")
+		exitWithSignal(session, sig, coreDumped)
+		return
+	}
+
+	// The error is only logged, as what went wrong on the server is none of
+	// the client's business, and the message would end up mixed with the
+	// output of the command.
+	if err != nil {
 		l.WithError(err).Errorln("Session ended")
 		session.Exit(1)
 		return
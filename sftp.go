@@ -0,0 +1,39 @@
+package sshd
+
+import (
+	"github.com/gliderlabs/ssh"
+	"github.com/inoc603/go-sshd/auth"
+	"github.com/inoc603/go-sshd/fsuser"
+	"github.com/inoc603/go-sshd/sftp"
+)
+
+// ServeSFTP is a SubsystemHandler for the sftp subsystem. Files are accessed
+// with the credentials of the user, and relative paths start from the user's
+// home directory.
+func ServeSFTP(session ssh.Session, user *auth.User, record func(e Event)) error {
+	return fsuser.Run(user, func() error {
+		server, err := sftp.NewServer(session,
+			sftp.WorkDir(user.Home),
+			sftp.OnEvent(func(e sftp.Event) {
+				fields := map[string]interface{}{
+					"path": e.Path,
+				}
+				if e.Target != "" {
+					fields["target"] = e.Target
+				}
+				if e.Bytes > 0 {
+					fields["bytes"] = e.Bytes
+				}
+				if e.Err != nil {
+					fields["error"] = e.Err.Error()
+				}
+				record(Event{Type: "sftp." + e.Op, Fields: fields})
+			}),
+		)
+		if err != nil {
+			return err
+		}
+
+		return server.Serve()
+	})
+}
@@ -0,0 +1,206 @@
+package sftp
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+	"time"
+)
+
+// Flags of the file attributes.
+const (
+	attrSize        = 0x00000001
+	attrUIDGID      = 0x00000002
+	attrPermissions = 0x00000004
+	attrACModTime   = 0x00000008
+	attrExtended    = 0x80000000
+)
+
+// File type and mode bits of POSIX, which is what the protocol uses for
+// permissions.
+const (
+	modeSocket    = 0140000
+	modeSymlink   = 0120000
+	modeRegular   = 0100000
+	modeBlock     = 0060000
+	modeDir       = 0040000
+	modeChar      = 0020000
+	modeNamedPipe = 0010000
+	modeSetuid    = 0004000
+	modeSetgid    = 0002000
+	modeSticky    = 0001000
+)
+
+type attrs struct {
+	flags uint32
+	size  uint64
+	uid   uint32
+	gid   uint32
+	perms uint32
+	atime uint32
+	mtime uint32
+}
+
+func (d *decoder) attrs() attrs {
+	var a attrs
+	a.flags = d.uint32()
+	if a.flags&attrSize != 0 {
+		a.size = d.uint64()
+	}
+	if a.flags&attrUIDGID != 0 {
+		a.uid = d.uint32()
+		a.gid = d.uint32()
+	}
+	if a.flags&attrPermissions != 0 {
+		a.perms = d.uint32()
+	}
+	if a.flags&attrACModTime != 0 {
+		a.atime = d.uint32()
+		a.mtime = d.uint32()
+	}
+	if a.flags&attrExtended != 0 {
+		for n := d.uint32(); n > 0 && d.err == nil; n-- {
+			d.string()
+			d.string()
+		}
+	}
+	return a
+}
+
+func appendAttrs(b []byte, a attrs) []byte {
+	b = appendUint32(b, a.flags)
+	if a.flags&attrSize != 0 {
+		b = appendUint64(b, a.size)
+	}
+	if a.flags&attrUIDGID != 0 {
+		b = appendUint32(b, a.uid)
+		b = appendUint32(b, a.gid)
+	}
+	if a.flags&attrPermissions != 0 {
+		b = appendUint32(b, a.perms)
+	}
+	if a.flags&attrACModTime != 0 {
+		b = appendUint32(b, a.atime)
+		b = appendUint32(b, a.mtime)
+	}
+	return b
+}
+
+// fileMode converts permissions sent by the client to an os.FileMode. Only
+// the permission and special bits are kept, the file type is implied by the
+// request.
+func fileMode(perms uint32) os.FileMode {
+	m := os.FileMode(perms & 0777)
+	if perms&modeSetuid != 0 {
+		m |= os.ModeSetuid
+	}
+	if perms&modeSetgid != 0 {
+		m |= os.ModeSetgid
+	}
+	if perms&modeSticky != 0 {
+		m |= os.ModeSticky
+	}
+	return m
+}
+
+func posixMode(m os.FileMode) uint32 {
+	perms := uint32(m.Perm())
+
+	switch {
+	case m&os.ModeDir != 0:
+		perms |= modeDir
+	case m&os.ModeSymlink != 0:
+		perms |= modeSymlink
+	case m&os.ModeNamedPipe != 0:
+		perms |= modeNamedPipe
+	case m&os.ModeSocket != 0:
+		perms |= modeSocket
+	case m&os.ModeCharDevice != 0:
+		perms |= modeChar
+	case m&os.ModeDevice != 0:
+		perms |= modeBlock
+	default:
+		perms |= modeRegular
+	}
+
+	if m&os.ModeSetuid != 0 {
+		perms |= modeSetuid
+	}
+	if m&os.ModeSetgid != 0 {
+		perms |= modeSetgid
+	}
+	if m&os.ModeSticky != 0 {
+		perms |= modeSticky
+	}
+
+	return perms
+}
+
+func fileAttrs(fi os.FileInfo) attrs {
+	a := attrs{
+		flags: attrSize | attrPermissions | attrACModTime,
+		size:  uint64(fi.Size()),
+		perms: posixMode(fi.Mode()),
+		atime: uint32(fi.ModTime().Unix()),
+		mtime: uint32(fi.ModTime().Unix()),
+	}
+
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		a.flags |= attrUIDGID
+		a.uid = st.Uid
+		a.gid = st.Gid
+	}
+
+	return a
+}
+
+// longName formats fi like a line of ls -l, which clients show as is.
+func longName(fi os.FileInfo) string {
+	var nlink uint64 = 1
+	var uid, gid uint32
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		nlink = uint64(st.Nlink)
+		uid, gid = st.Uid, st.Gid
+	}
+
+	perms := posixMode(fi.Mode())
+	mode := []byte("?rwxrwxrwx")
+	switch perms & 0170000 {
+	case modeDir:
+		mode[0] = 'd'
+	case modeSymlink:
+		mode[0] = 'l'
+	case modeNamedPipe:
+		mode[0] = 'p'
+	case modeSocket:
+		mode[0] = 's'
+	case modeChar:
+		mode[0] = 'c'
+	case modeBlock:
+		mode[0] = 'b'
+	case modeRegular:
+		mode[0] = '-'
+	}
+	for i := uint(0); i < 9; i++ {
+		if perms&(1<<(8-i)) == 0 {
+			mode[i+1] = '-'
+		}
+	}
+	if perms&modeSetuid != 0 {
+		mode[3] = "Ss"[perms>>6&1]
+	}
+	if perms&modeSetgid != 0 {
+		mode[6] = "Ss"[perms>>3&1]
+	}
+	if perms&modeSticky != 0 {
+		mode[9] = "Tt"[perms&1]
+	}
+
+	layout := "Jan _2 15:04"
+	if mtime := fi.ModTime(); time.Since(mtime) > 180*24*time.Hour || mtime.After(time.Now()) {
+		layout = "Jan _2  2006"
+	}
+
+	return fmt.Sprintf("%s %4d %-8d %-8d %8d %s %s",
+		mode, nlink, uid, gid, fi.Size(), fi.ModTime().Format(layout), fi.Name())
+}
@@ -0,0 +1,148 @@
+package sftp
+
+import (
+	"encoding/binary"
+	"io"
+
+	"github.com/pkg/errors"
+)
+
+// Packet types of SFTP version 3, as specified in
+// https://tools.ietf.org/html/draft-ietf-secsh-filexfer-02
+const (
+	fxpInit          = 1
+	fxpVersion       = 2
+	fxpOpen          = 3
+	fxpClose         = 4
+	fxpRead          = 5
+	fxpWrite         = 6
+	fxpLstat         = 7
+	fxpFstat         = 8
+	fxpSetstat       = 9
+	fxpFsetstat      = 10
+	fxpOpendir       = 11
+	fxpReaddir       = 12
+	fxpRemove        = 13
+	fxpMkdir         = 14
+	fxpRmdir         = 15
+	fxpRealpath      = 16
+	fxpStat          = 17
+	fxpRename        = 18
+	fxpReadlink      = 19
+	fxpSymlink       = 20
+	fxpStatus        = 101
+	fxpHandle        = 102
+	fxpData          = 103
+	fxpName          = 104
+	fxpAttrs         = 105
+	fxpExtended      = 200
+	fxpExtendedReply = 201
+)
+
+// Status codes sent in SSH_FXP_STATUS packets.
+const (
+	fxOK               = 0
+	fxEOF              = 1
+	fxNoSuchFile       = 2
+	fxPermissionDenied = 3
+	fxFailure          = 4
+	fxBadMessage       = 5
+	fxOpUnsupported    = 8
+)
+
+// Flags of SSH_FXP_OPEN.
+const (
+	fxfRead   = 0x00000001
+	fxfWrite  = 0x00000002
+	fxfAppend = 0x00000004
+	fxfCreat  = 0x00000008
+	fxfTrunc  = 0x00000010
+	fxfExcl   = 0x00000020
+)
+
+// maxPacketSize is the largest packet the server accepts. Clients usually
+// don't send more than 32k of data in a single write.
+const maxPacketSize = 256 * 1024
+
+var errShortPacket = errors.New("packet too short")
+
+func readPacket(r io.Reader) (byte, []byte, error) {
+	var header [4]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return 0, nil, err
+	}
+
+	length := binary.BigEndian.Uint32(header[:])
+	if length == 0 || length > maxPacketSize {
+		return 0, nil, errors.Errorf("invalid packet length %d", length)
+	}
+
+	b := make([]byte, length)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return 0, nil, errors.Wrap(err, "read packet")
+	}
+
+	return b[0], b[1:], nil
+}
+
+func writePacket(w io.Writer, typ byte, payload []byte) error {
+	b := make([]byte, 5, 5+len(payload))
+	binary.BigEndian.PutUint32(b, uint32(len(payload)+1))
+	b[4] = typ
+	_, err := w.Write(append(b, payload...))
+	return err
+}
+
+// decoder reads the fields of a packet. After the first failure every read
+// returns a zero value and err is set.
+type decoder struct {
+	b   []byte
+	err error
+}
+
+func (d *decoder) uint32() uint32 {
+	if d.err != nil || len(d.b) < 4 {
+		d.err = errShortPacket
+		return 0
+	}
+	v := binary.BigEndian.Uint32(d.b)
+	d.b = d.b[4:]
+	return v
+}
+
+func (d *decoder) uint64() uint64 {
+	if d.err != nil || len(d.b) < 8 {
+		d.err = errShortPacket
+		return 0
+	}
+	v := binary.BigEndian.Uint64(d.b)
+	d.b = d.b[8:]
+	return v
+}
+
+func (d *decoder) bytes() []byte {
+	n := d.uint32()
+	if d.err != nil || uint32(len(d.b)) < n {
+		d.err = errShortPacket
+		return nil
+	}
+	v := d.b[:n]
+	d.b = d.b[n:]
+	return v
+}
+
+func (d *decoder) string() string {
+	return string(d.bytes())
+}
+
+func appendUint32(b []byte, v uint32) []byte {
+	return append(b, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+func appendUint64(b []byte, v uint64) []byte {
+	return appendUint32(appendUint32(b, uint32(v>>32)), uint32(v))
+}
+
+func appendString(b []byte, s string) []byte {
+	return append(appendUint32(b, uint32(len(s))), s...)
+}
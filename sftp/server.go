@@ -0,0 +1,646 @@
+// Package sftp implements the server side of the SSH file transfer protocol,
+// version 3.
+package sftp
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// maxReadSize limits the data returned for a single read request.
+const maxReadSize = 64 * 1024
+
+// readdirBatch is how many directory entries are sent for a single readdir
+// request.
+const readdirBatch = 128
+
+// Event describes a file operation requested by the client. Reads and writes
+// are reported once per file when its handle is closed, with the number of
+// bytes transferred.
+type Event struct {
+	Op     string // open, read, write, setstat, remove, mkdir, rmdir, rename or symlink
+	Path   string
+	Target string // the new path of rename, and the link of symlink
+	Bytes  int64
+	Err    error
+}
+
+// Server serves SFTP requests read from a stream, usually the channel of an
+// SSH session which requested the sftp subsystem. Files are accessed with the
+// credentials of the calling thread.
+type Server struct {
+	rw      io.ReadWriter
+	workDir string
+	onEvent func(e Event)
+
+	handles    map[string]*handle
+	nextHandle uint64
+}
+
+type handle struct {
+	file    *os.File
+	path    string
+	dir     bool
+	append  bool
+	read    int64
+	written int64
+}
+
+type Option func(s *Server) error
+
+// WorkDir sets the directory relative paths are resolved against. It is the
+// root directory by default.
+func WorkDir(dir string) Option {
+	return func(s *Server) error {
+		if !filepath.IsAbs(dir) {
+			return errors.Errorf("work directory %s is not absolute", dir)
+		}
+		s.workDir = filepath.Clean(dir)
+		return nil
+	}
+}
+
+// OnEvent sets a callback that is called for every file operation.
+func OnEvent(fn func(e Event)) Option {
+	return func(s *Server) error {
+		s.onEvent = fn
+		return nil
+	}
+}
+
+func NewServer(rw io.ReadWriter, opts ...Option) (*Server, error) {
+	s := &Server{
+		rw:      rw,
+		workDir: "/",
+		onEvent: func(Event) {},
+		handles: make(map[string]*handle),
+	}
+
+	for _, opt := range opts {
+		if err := opt(s); err != nil {
+			return nil, err
+		}
+	}
+
+	return s, nil
+}
+
+// Serve handles requests until the client closes the stream. Requests are
+// handled one at a time, in the order they arrive.
+func (s *Server) Serve() error {
+	defer s.closeHandles()
+
+	for {
+		typ, payload, err := readPacket(s.rw)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		if typ == fxpInit {
+			// The client sends its version, which is at least 3 in practice.
+			reply := appendUint32(nil, 3)
+			reply = appendString(reply, "posix-rename@openssh.com")
+			reply = appendString(reply, "1")
+			err = writePacket(s.rw, fxpVersion, reply)
+		} else {
+			d := &decoder{b: payload}
+			id := d.uint32()
+			if d.err != nil {
+				return errors.Wrap(d.err, "read request id")
+			}
+			replyType, reply := s.handle(typ, d)
+			err = writePacket(s.rw, replyType, append(appendUint32(nil, id), reply...))
+		}
+
+		if err != nil {
+			return errors.Wrap(err, "write reply")
+		}
+	}
+}
+
+func (s *Server) closeHandles() {
+	for id := range s.handles {
+		s.closeHandle(id)
+	}
+}
+
+func (s *Server) closeHandle(id string) error {
+	h := s.handles[id]
+	delete(s.handles, id)
+
+	err := h.file.Close()
+	if h.read > 0 {
+		s.onEvent(Event{Op: "read", Path: h.path, Bytes: h.read})
+	}
+	if h.written > 0 {
+		s.onEvent(Event{Op: "write", Path: h.path, Bytes: h.written})
+	}
+
+	return err
+}
+
+func (s *Server) newHandle(h *handle) []byte {
+	s.nextHandle++
+	id := strconv.FormatUint(s.nextHandle, 10)
+	s.handles[id] = h
+	return appendString(nil, id)
+}
+
+// path resolves p against the work directory.
+func (s *Server) path(p string) string {
+	if !filepath.IsAbs(p) {
+		p = filepath.Join(s.workDir, p)
+	}
+	return filepath.Clean(p)
+}
+
+// event reports a file operation, and replies to it with its result.
+func (s *Server) event(e Event) (byte, []byte) {
+	s.onEvent(e)
+	return status(e.Err)
+}
+
+func status(err error) (byte, []byte) {
+	code := uint32(fxOK)
+	msg := "Success"
+
+	switch {
+	case err == nil:
+	case err == io.EOF:
+		code, msg = fxEOF, "End of file"
+	case os.IsNotExist(err):
+		code, msg = fxNoSuchFile, "No such file"
+	case os.IsPermission(err):
+		code, msg = fxPermissionDenied, "Permission denied"
+	case errors.Cause(err) == errShortPacket:
+		code, msg = fxBadMessage, "Bad message"
+	default:
+		code, msg = fxFailure, err.Error()
+	}
+
+	reply := appendUint32(nil, code)
+	reply = appendString(reply, msg)
+	reply = appendString(reply, "en")
+	return fxpStatus, reply
+}
+
+func unsupported() (byte, []byte) {
+	reply := appendUint32(nil, fxOpUnsupported)
+	reply = appendString(reply, "Operation unsupported")
+	reply = appendString(reply, "en")
+	return fxpStatus, reply
+}
+
+func names(entries ...[]byte) (byte, []byte) {
+	reply := appendUint32(nil, uint32(len(entries)))
+	for _, e := range entries {
+		reply = append(reply, e...)
+	}
+	return fxpName, reply
+}
+
+func nameEntry(name, long string, a attrs) []byte {
+	b := appendString(nil, name)
+	b = appendString(b, long)
+	return appendAttrs(b, a)
+}
+
+func (s *Server) handle(typ byte, d *decoder) (byte, []byte) {
+	switch typ {
+	case fxpOpen:
+		return s.open(d)
+	case fxpClose:
+		return s.close(d)
+	case fxpRead:
+		return s.read(d)
+	case fxpWrite:
+		return s.write(d)
+	case fxpLstat, fxpStat:
+		return s.stat(d, typ == fxpLstat)
+	case fxpFstat:
+		return s.fstat(d)
+	case fxpSetstat:
+		return s.setstat(d)
+	case fxpFsetstat:
+		return s.fsetstat(d)
+	case fxpOpendir:
+		return s.opendir(d)
+	case fxpReaddir:
+		return s.readdir(d)
+	case fxpRemove:
+		return s.remove(d)
+	case fxpMkdir:
+		return s.mkdir(d)
+	case fxpRmdir:
+		return s.rmdir(d)
+	case fxpRealpath:
+		return s.realpath(d)
+	case fxpRename:
+		return s.rename(d, false)
+	case fxpReadlink:
+		return s.readlink(d)
+	case fxpSymlink:
+		return s.symlink(d)
+	case fxpExtended:
+		switch d.string() {
+		case "posix-rename@openssh.com":
+			return s.rename(d, true)
+		}
+	}
+	return unsupported()
+}
+
+func (s *Server) getHandle(id string) (*handle, error) {
+	h, ok := s.handles[id]
+	if !ok {
+		return nil, errors.Errorf("invalid handle")
+	}
+	return h, nil
+}
+
+func (s *Server) open(d *decoder) (byte, []byte) {
+	path := s.path(d.string())
+	pflags := d.uint32()
+	a := d.attrs()
+	if d.err != nil {
+		return status(d.err)
+	}
+
+	var flag int
+	switch {
+	case pflags&fxfRead != 0 && pflags&fxfWrite != 0:
+		flag = os.O_RDWR
+	case pflags&fxfWrite != 0:
+		flag = os.O_WRONLY
+	default:
+		flag = os.O_RDONLY
+	}
+	if pflags&fxfAppend != 0 {
+		flag |= os.O_APPEND
+	}
+	if pflags&fxfCreat != 0 {
+		flag |= os.O_CREATE
+	}
+	if pflags&fxfTrunc != 0 {
+		flag |= os.O_TRUNC
+	}
+	if pflags&fxfExcl != 0 {
+		flag |= os.O_EXCL
+	}
+
+	perm := os.FileMode(0666)
+	if a.flags&attrPermissions != 0 {
+		perm = fileMode(a.perms)
+	}
+
+	f, err := os.OpenFile(path, flag, perm)
+	s.onEvent(Event{Op: "open", Path: path, Err: err})
+	if err != nil {
+		return status(err)
+	}
+
+	return fxpHandle, s.newHandle(&handle{
+		file:   f,
+		path:   path,
+		append: flag&os.O_APPEND != 0,
+	})
+}
+
+func (s *Server) close(d *decoder) (byte, []byte) {
+	id := d.string()
+	if d.err != nil {
+		return status(d.err)
+	}
+
+	if _, err := s.getHandle(id); err != nil {
+		return status(err)
+	}
+
+	return status(s.closeHandle(id))
+}
+
+func (s *Server) read(d *decoder) (byte, []byte) {
+	id := d.string()
+	offset := d.uint64()
+	length := d.uint32()
+	if d.err != nil {
+		return status(d.err)
+	}
+
+	h, err := s.getHandle(id)
+	if err != nil {
+		return status(err)
+	}
+
+	if length > maxReadSize {
+		length = maxReadSize
+	}
+
+	b := make([]byte, length)
+	n, err := h.file.ReadAt(b, int64(offset))
+	if n == 0 {
+		if err == nil {
+			err = io.EOF
+		}
+		return status(err)
+	}
+
+	h.read += int64(n)
+	return fxpData, appendString(nil, string(b[:n]))
+}
+
+func (s *Server) write(d *decoder) (byte, []byte) {
+	id := d.string()
+	offset := d.uint64()
+	data := d.bytes()
+	if d.err != nil {
+		return status(d.err)
+	}
+
+	h, err := s.getHandle(id)
+	if err != nil {
+		return status(err)
+	}
+
+	var n int
+	if h.append {
+		// WriteAt is not allowed on files opened with O_APPEND.
+		n, err = h.file.Write(data)
+	} else {
+		n, err = h.file.WriteAt(data, int64(offset))
+	}
+	h.written += int64(n)
+
+	return status(err)
+}
+
+func (s *Server) stat(d *decoder, lstat bool) (byte, []byte) {
+	path := s.path(d.string())
+	if d.err != nil {
+		return status(d.err)
+	}
+
+	stat := os.Stat
+	if lstat {
+		stat = os.Lstat
+	}
+
+	fi, err := stat(path)
+	if err != nil {
+		return status(err)
+	}
+
+	return fxpAttrs, appendAttrs(nil, fileAttrs(fi))
+}
+
+func (s *Server) fstat(d *decoder) (byte, []byte) {
+	id := d.string()
+	if d.err != nil {
+		return status(d.err)
+	}
+
+	h, err := s.getHandle(id)
+	if err != nil {
+		return status(err)
+	}
+
+	fi, err := h.file.Stat()
+	if err != nil {
+		return status(err)
+	}
+
+	return fxpAttrs, appendAttrs(nil, fileAttrs(fi))
+}
+
+// setAttrs applies the attributes set by the client to the file at path. f is
+// used instead of the path where possible.
+func setAttrs(path string, f *os.File, a attrs) error {
+	if a.flags&attrSize != 0 {
+		var err error
+		if f != nil {
+			err = f.Truncate(int64(a.size))
+		} else {
+			err = os.Truncate(path, int64(a.size))
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	if a.flags&attrPermissions != 0 {
+		var err error
+		if f != nil {
+			err = f.Chmod(fileMode(a.perms))
+		} else {
+			err = os.Chmod(path, fileMode(a.perms))
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	if a.flags&attrUIDGID != 0 {
+		var err error
+		if f != nil {
+			err = f.Chown(int(a.uid), int(a.gid))
+		} else {
+			err = os.Chown(path, int(a.uid), int(a.gid))
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	if a.flags&attrACModTime != 0 {
+		atime := time.Unix(int64(a.atime), 0)
+		mtime := time.Unix(int64(a.mtime), 0)
+		if err := os.Chtimes(path, atime, mtime); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *Server) setstat(d *decoder) (byte, []byte) {
+	path := s.path(d.string())
+	a := d.attrs()
+	if d.err != nil {
+		return status(d.err)
+	}
+
+	return s.event(Event{Op: "setstat", Path: path, Err: setAttrs(path, nil, a)})
+}
+
+func (s *Server) fsetstat(d *decoder) (byte, []byte) {
+	id := d.string()
+	a := d.attrs()
+	if d.err != nil {
+		return status(d.err)
+	}
+
+	h, err := s.getHandle(id)
+	if err != nil {
+		return status(err)
+	}
+
+	return s.event(Event{Op: "setstat", Path: h.path, Err: setAttrs(h.path, h.file, a)})
+}
+
+func (s *Server) opendir(d *decoder) (byte, []byte) {
+	path := s.path(d.string())
+	if d.err != nil {
+		return status(d.err)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return status(err)
+	}
+
+	if fi, err := f.Stat(); err != nil || !fi.IsDir() {
+		f.Close()
+		if err == nil {
+			err = errors.Errorf("%s is not a directory", path)
+		}
+		return status(err)
+	}
+
+	return fxpHandle, s.newHandle(&handle{file: f, path: path, dir: true})
+}
+
+func (s *Server) readdir(d *decoder) (byte, []byte) {
+	id := d.string()
+	if d.err != nil {
+		return status(d.err)
+	}
+
+	h, err := s.getHandle(id)
+	if err != nil {
+		return status(err)
+	}
+	if !h.dir {
+		return status(errors.Errorf("%s is not a directory", h.path))
+	}
+
+	fis, err := h.file.Readdir(readdirBatch)
+	if len(fis) == 0 {
+		if err == nil {
+			err = io.EOF
+		}
+		return status(err)
+	}
+
+	entries := make([][]byte, 0, len(fis))
+	for _, fi := range fis {
+		entries = append(entries, nameEntry(fi.Name(), longName(fi), fileAttrs(fi)))
+	}
+
+	return names(entries...)
+}
+
+func (s *Server) remove(d *decoder) (byte, []byte) {
+	path := s.path(d.string())
+	if d.err != nil {
+		return status(d.err)
+	}
+
+	var err error
+	if e := syscall.Unlink(path); e != nil {
+		err = &os.PathError{Op: "remove", Path: path, Err: e}
+	}
+
+	return s.event(Event{Op: "remove", Path: path, Err: err})
+}
+
+func (s *Server) mkdir(d *decoder) (byte, []byte) {
+	path := s.path(d.string())
+	a := d.attrs()
+	if d.err != nil {
+		return status(d.err)
+	}
+
+	perm := os.FileMode(0777)
+	if a.flags&attrPermissions != 0 {
+		perm = fileMode(a.perms)
+	}
+
+	return s.event(Event{Op: "mkdir", Path: path, Err: os.Mkdir(path, perm)})
+}
+
+func (s *Server) rmdir(d *decoder) (byte, []byte) {
+	path := s.path(d.string())
+	if d.err != nil {
+		return status(d.err)
+	}
+
+	var err error
+	if e := syscall.Rmdir(path); e != nil {
+		err = &os.PathError{Op: "rmdir", Path: path, Err: e}
+	}
+
+	return s.event(Event{Op: "rmdir", Path: path, Err: err})
+}
+
+func (s *Server) realpath(d *decoder) (byte, []byte) {
+	path := s.path(d.string())
+	if d.err != nil {
+		return status(d.err)
+	}
+
+	return names(nameEntry(path, path, attrs{}))
+}
+
+// rename moves a file. Like OpenSSH, the plain SFTP rename refuses to replace
+// an existing file, while the posix-rename extension does.
+func (s *Server) rename(d *decoder, posix bool) (byte, []byte) {
+	oldpath := s.path(d.string())
+	newpath := s.path(d.string())
+	if d.err != nil {
+		return status(d.err)
+	}
+
+	var err error
+	if _, e := os.Lstat(newpath); !posix && e == nil {
+		err = errors.Errorf("%s already exists", newpath)
+	} else {
+		err = os.Rename(oldpath, newpath)
+	}
+
+	return s.event(Event{Op: "rename", Path: oldpath, Target: newpath, Err: err})
+}
+
+func (s *Server) readlink(d *decoder) (byte, []byte) {
+	path := s.path(d.string())
+	if d.err != nil {
+		return status(d.err)
+	}
+
+	target, err := os.Readlink(path)
+	if err != nil {
+		return status(err)
+	}
+
+	return names(nameEntry(target, target, attrs{}))
+}
+
+// symlink creates a symbolic link. The arguments are in the order OpenSSH
+// sends them, which is the reverse of the draft: the target comes first.
+func (s *Server) symlink(d *decoder) (byte, []byte) {
+	target := d.string()
+	link := s.path(d.string())
+	if d.err != nil {
+		return status(d.err)
+	}
+
+	return s.event(Event{Op: "symlink", Path: target, Target: link, Err: os.Symlink(target, link)})
+}
@@ -0,0 +1,129 @@
+package sshd
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/gliderlabs/ssh"
+)
+
+// ErrServerClosed is returned by Start and Serve once the server is closed or
+// shut down.
+var ErrServerClosed = ssh.ErrServerClosed
+
+// track keeps track of the sessions served by h, so they can be told when
+// the server shuts down.
+func (s *Server) track(h ssh.Handler) ssh.Handler {
+	return func(session ssh.Session) {
+		s.mu.Lock()
+		s.sessions[session] = struct{}{}
+		s.mu.Unlock()
+
+		defer func() {
+			s.mu.Lock()
+			delete(s.sessions, session)
+			s.mu.Unlock()
+		}()
+
+		h(session)
+	}
+}
+
+// notify writes msg to the stderr of every active session.
+func (s *Server) notify(msg string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for session := range s.sessions {
+		eol := "\n"
+		if _, _, isPty := session.Pty(); isPty {
+			eol = "\r\n"
+		}
+		fmt.Fprint(session.Stderr(), eol+msg+eol)
+	}
+}
+
+// closeRecorders closes the recorders of the sessions still running.
+func (s *Server) closeRecorders() {
+	s.mu.Lock()
+	recorders := make([]*openRecorder, 0, len(s.recorders))
+	for rec := range s.recorders {
+		recorders = append(recorders, rec)
+	}
+	s.mu.Unlock()
+
+	for _, rec := range recorders {
+		s.closeRecorder(rec)
+	}
+}
+
+// stopping returns the underlying server if it was started, and stops
+// watching the authentication methods, as it is about to stop.
+func (s *Server) stopping() *ssh.Server {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.stopWatch != nil {
+		s.stopWatch()
+	}
+	return s.srv
+}
+
+// Close stops the server right away, closing its listeners and connections,
+// and closes the recorders of the sessions.
+func (s *Server) Close() error {
+	srv := s.stopping()
+	if srv == nil {
+		return nil
+	}
+
+	err := srv.Close()
+	s.closeRecorders()
+	return err
+}
+
+// Shutdown stops accepting connections, tells the clients of active sessions
+// the server is shutting down, and waits for the connections to end. Once ctx
+// is done, the remaining connections are closed and the error of ctx is
+// returned. The recorders of the sessions are closed in any case.
+func (s *Server) Shutdown(ctx context.Context) error {
+	return s.shutdown(ctx, s.shutdownMessage)
+}
+
+// Drain is like Shutdown without telling the clients, for when another
+// process serves the new connections after an Upgrade.
+func (s *Server) Drain(ctx context.Context) error {
+	return s.shutdown(ctx, "")
+}
+
+func (s *Server) shutdown(ctx context.Context, msg string) error {
+	srv := s.stopping()
+	if srv == nil {
+		return nil
+	}
+
+	// The listeners are closed first thing by ssh.Server.Shutdown, which
+	// then waits for the connections.
+	done := make(chan error, 1)
+	go func() {
+		done <- srv.Shutdown(ctx)
+	}()
+
+	s.mu.Lock()
+	active := len(s.sessions)
+	s.mu.Unlock()
+	logrus.WithField("sessions", active).Infoln("Shutting down")
+	if msg != "" {
+		s.notify(msg)
+	}
+
+	err := <-done
+	if err != nil {
+		logrus.WithError(err).Warnln("Closing the remaining connections")
+		srv.Close()
+	}
+
+	s.closeRecorders()
+	return err
+}
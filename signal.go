@@ -0,0 +1,127 @@
+package sshd
+
+import (
+	"os/exec"
+	"syscall"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/gliderlabs/ssh"
+	"github.com/pkg/errors"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// signals maps the signal names of RFC 4254 to the signals of the host.
+var signals = map[ssh.Signal]syscall.Signal{
+	ssh.SIGABRT: syscall.SIGABRT,
+	ssh.SIGALRM: syscall.SIGALRM,
+	ssh.SIGFPE:  syscall.SIGFPE,
+	ssh.SIGHUP:  syscall.SIGHUP,
+	ssh.SIGILL:  syscall.SIGILL,
+	ssh.SIGINT:  syscall.SIGINT,
+	ssh.SIGKILL: syscall.SIGKILL,
+	ssh.SIGPIPE: syscall.SIGPIPE,
+	ssh.SIGQUIT: syscall.SIGQUIT,
+	ssh.SIGSEGV: syscall.SIGSEGV,
+	ssh.SIGTERM: syscall.SIGTERM,
+	ssh.SIGUSR1: syscall.SIGUSR1,
+	ssh.SIGUSR2: syscall.SIGUSR2,
+}
+
+// signalName returns the RFC 4254 name of sig, falling back to the name
+// OpenSSH uses for signals missing from the RFC.
+func signalName(sig syscall.Signal) ssh.Signal {
+	for name, s := range signals {
+		if s == sig {
+			return name
+		}
+	}
+	return "SIG@openssh.com"
+}
+
+// exitSignal returns the signal that killed the process, and whether it
+// dumped core, if err is caused by the process being killed.
+func exitSignal(err error) (syscall.Signal, bool, bool) {
+	exitErr, ok := errors.Cause(err).(*exec.ExitError)
+	if !ok {
+		return 0, false, false
+	}
+
+	status, ok := exitErr.Sys().(syscall.WaitStatus)
+	if !ok || !status.Signaled() {
+		return 0, false, false
+	}
+
+	return status.Signal(), status.CoreDump(), true
+}
+
+// exitSignalMsg is the payload of an exit-signal request, as specified in
+// RFC 4254, section 6.10.
+type exitSignalMsg struct {
+	Signal     string
+	CoreDumped bool
+	Error      string
+	Lang       string
+}
+
+// exitWithSignal tells the client the command was killed by sig and closes the
+// session, which is what Session.Exit does for commands that exited.
+func exitWithSignal(session ssh.Session, sig syscall.Signal, coreDumped bool) error {
+	msg := exitSignalMsg{
+		Signal:     string(signalName(sig)),
+		CoreDumped: coreDumped,
+	}
+	if _, err := session.SendRequest("exit-signal", false, gossh.Marshal(&msg)); err != nil {
+		return err
+	}
+	return session.Close()
+}
+
+// wait waits for cmd to exit. Until then, signals sent by the client are
+// delivered to the process group of cmd, which is expected to lead its own
+// group, and the group gets SIGHUP if the client closes the session or
+// disconnects.
+func wait(cmd *exec.Cmd, session ssh.Session) error {
+	l := logrus.WithFields(logrus.Fields{
+		"user":       session.User(),
+		"session_id": session.Context().(ssh.Context).SessionID(),
+	})
+
+	pgid := cmd.Process.Pid
+	sigs := make(chan ssh.Signal, 1)
+	done := make(chan struct{})
+	session.Signals(sigs)
+
+	go func() {
+		for {
+			select {
+			case sig := <-sigs:
+				signum, ok := signals[sig]
+				if !ok {
+					l.WithField("signal", sig).Warnln("Ignored unknown signal")
+					continue
+				}
+				l.WithField("signal", sig).Infoln("Delivering signal")
+				syscall.Kill(-pgid, signum)
+			case <-session.Closed():
+				l.Infoln("Session closed, sending SIGHUP")
+				syscall.Kill(-pgid, syscall.SIGHUP)
+				return
+			case <-session.Context().Done():
+				l.Infoln("Client disconnected, sending SIGHUP")
+				syscall.Kill(-pgid, syscall.SIGHUP)
+				return
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	err := cmd.Wait()
+
+	// Unregister first, as the request loop of the session might be blocked
+	// sending a signal the goroutine above has to receive.
+	session.Signals(nil)
+	close(done)
+
+	return err
+}
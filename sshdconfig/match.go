@@ -0,0 +1,137 @@
+package sshdconfig
+
+import (
+	"net"
+	"strings"
+
+	sshd "github.com/inoc603/go-sshd"
+	"github.com/pkg/errors"
+)
+
+// matchable are the directives go-sshd applies in Match blocks.
+var matchable = map[string]bool{
+	"forcecommand":               true,
+	"allowagentforwarding":       true,
+	"x11forwarding":              true,
+	"allowtcpforwarding":         true,
+	"permitopen":                 true,
+	"permitlisten":               true,
+	"gatewayports":               true,
+	"allowstreamlocalforwarding": true,
+}
+
+// criteriaRule returns the rule matching the criteria of m. Blocks with
+// criteria go-sshd can't check are refused, as skipping them would lose their
+// restrictions and applying them to other connections could grant too much.
+func criteriaRule(file string, m Match) (sshd.MatchRule, error) {
+	var rule sshd.MatchRule
+	for _, c := range m.Criteria {
+		values := strings.Split(c.Value, ",")
+		for _, v := range values {
+			if strings.HasPrefix(v, "!") {
+				return rule, errors.Errorf("%s:%d: negated Match patterns are not supported", file, m.Line)
+			}
+		}
+
+		switch c.Name {
+		case "all":
+		case "user":
+			rule.Users = append(rule.Users, values...)
+		case "group":
+			rule.Groups = append(rule.Groups, values...)
+		case "address":
+			for _, v := range values {
+				network, err := parseNetwork(v)
+				if err != nil {
+					return rule, errors.Wrapf(err, "%s:%d", file, m.Line)
+				}
+				rule.Networks = append(rule.Networks, network)
+			}
+		default:
+			return rule, errors.Errorf("%s:%d: Match criterion %s is not supported", file, m.Line, c.Name)
+		}
+	}
+
+	return rule, nil
+}
+
+// parseNetwork parses addresses like 10.0.0.0/8 or 192.168.1.1.
+func parseNetwork(s string) (*net.IPNet, error) {
+	if !strings.Contains(s, "/") {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil, errors.Errorf("invalid address %q", s)
+		}
+		bits := 8 * net.IPv6len
+		if ip.To4() != nil {
+			ip, bits = ip.To4(), 8*net.IPv4len
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+	}
+
+	_, network, err := net.ParseCIDR(s)
+	if err != nil {
+		return nil, errors.Errorf("invalid address %q", s)
+	}
+	return network, nil
+}
+
+// matchRules translates the Match blocks of c into rules overriding global.
+func (c *Config) matchRules(global *settings) ([]sshd.MatchRule, error) {
+	var rules []sshd.MatchRule
+
+	for _, m := range c.Matches {
+		rule, err := criteriaRule(c.File, m)
+		if err != nil {
+			return nil, err
+		}
+
+		// The directives of the block are applied on top of the global
+		// ones, as settings like PermitOpen depend on each other.
+		s := *global
+		s.seen = make(map[string]bool)
+		for _, d := range m.Directives {
+			if !matchable[d.Keyword] {
+				return nil, errors.Errorf("%s:%d: %s is not supported in Match blocks", c.File, d.Line, d.Keyword)
+			}
+			if err := s.apply(c.File, d); err != nil {
+				return nil, errors.Wrapf(err, "%s:%d", c.File, d.Line)
+			}
+		}
+
+		o := &rule.Overrides
+		if s.seen["forcecommand"] {
+			o.ForceCommand = &s.forceCommand
+		}
+		if s.seen["allowagentforwarding"] {
+			o.AgentForwarding = &s.agentForwarding
+		}
+		if s.seen["x11forwarding"] {
+			o.X11Forwarding = &s.x11Forwarding
+		}
+
+		// Empty policies disable forwarding, while nil ones would leave it
+		// as it is.
+		if s.seen["allowtcpforwarding"] || s.seen["permitopen"] {
+			policy, err := s.localForwarding()
+			if err != nil {
+				return nil, errors.Wrapf(err, "%s:%d", c.File, m.Line)
+			}
+			o.LocalForwarding = append(sshd.ForwardPolicy{}, policy...)
+		}
+		if s.seen["allowtcpforwarding"] || s.seen["permitlisten"] || s.seen["gatewayports"] {
+			policy, err := s.remoteForwarding()
+			if err != nil {
+				return nil, errors.Wrapf(err, "%s:%d", c.File, m.Line)
+			}
+			o.RemoteForwarding = append(sshd.ForwardPolicy{}, policy...)
+		}
+		if s.seen["allowstreamlocalforwarding"] {
+			o.StreamLocalForwarding = append(sshd.StreamLocalPolicy{}, s.streamLocalForwarding(c.File)...)
+		}
+
+		rules = append(rules, rule)
+	}
+
+	return rules, nil
+}
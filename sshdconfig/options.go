@@ -0,0 +1,610 @@
+package sshdconfig
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	sshd "github.com/inoc603/go-sshd"
+	"github.com/inoc603/go-sshd/auth"
+	"github.com/inoc603/go-sshd/fsuser"
+	"github.com/pkg/errors"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// PAMService is the PAM service password authentication goes through, the
+// same as OpenSSH.
+const PAMService = "sshd"
+
+// defaultHostKeys are the host keys used without a HostKey directive, if they
+// exist.
+var defaultHostKeys = []string{
+	"/etc/ssh/ssh_host_rsa_key",
+	"/etc/ssh/ssh_host_ecdsa_key",
+	"/etc/ssh/ssh_host_ed25519_key",
+}
+
+// multiple are the keywords which can be given more than once. Like OpenSSH,
+// only the first value of the other keywords is used.
+var multiple = map[string]bool{
+	"port":          true,
+	"listenaddress": true,
+	"hostkey":       true,
+	"acceptenv":     true,
+	"allowusers":    true,
+	"denyusers":     true,
+	"allowgroups":   true,
+	"denygroups":    true,
+	"subsystem":     true,
+}
+
+// compatible are directives go-sshd doesn't support, along with the value it
+// behaves like. They are only warned about when set to something else.
+var compatible = map[string]string{
+	"usepam":                          "yes",
+	"challengeresponseauthentication": "no",
+	"kbdinteractiveauthentication":    "no",
+	"permitemptypasswords":            "no",
+	"printmotd":                       "no",
+	"printlastlog":                    "no",
+	"usedns":                          "no",
+	"permittunnel":                    "no",
+	"x11uselocalhost":                 "yes",
+	"tcpkeepalive":                    "yes",
+}
+
+// settings are the values of the directives go-sshd supports, with the
+// defaults of OpenSSH.
+type settings struct {
+	seen map[string]bool
+
+	ports               []string
+	listenAddresses     []string
+	hostKeys            []string
+	permitRootLogin     sshd.RootLogin
+	passwordAuth        bool
+	pubkeyAuth          bool
+	authorizedKeysFiles []string
+	trustedUserCAKeys   string
+	revokedKeys         string
+	strictModes         bool
+	allowUsers          []string
+	denyUsers           []string
+	allowGroups         []string
+	denyGroups          []string
+	forceCommand        string
+	banner              string
+	clientAliveInterval time.Duration
+	clientAliveCountMax int
+	acceptEnv           []string
+	userEnvironment     []string
+	agentForwarding     bool
+	x11Forwarding       bool
+	tcpForwarding       string
+	gatewayPorts        string
+	permitOpen          []string
+	permitListen        []string
+	streamLocal         string
+	sftp                bool
+}
+
+func defaults() *settings {
+	return &settings{
+		seen:                make(map[string]bool),
+		permitRootLogin:     sshd.RootLoginProhibitPassword,
+		passwordAuth:        true,
+		pubkeyAuth:          true,
+		authorizedKeysFiles: auth.DefaultUserKeysFiles,
+		strictModes:         true,
+		clientAliveCountMax: 3,
+		agentForwarding:     true,
+		tcpForwarding:       "yes",
+		gatewayPorts:        "no",
+		permitOpen:          []string{"any"},
+		permitListen:        []string{"any"},
+		streamLocal:         "yes",
+	}
+}
+
+// warn logs a directive go-sshd ignores.
+func warn(file string, d Directive, msg string) {
+	logrus.WithFields(logrus.Fields{
+		"file":    file,
+		"line":    d.Line,
+		"keyword": d.Keyword,
+	}).Warnln(msg)
+}
+
+func yesNo(d Directive) (bool, error) {
+	switch strings.ToLower(d.Args[0]) {
+	case "yes":
+		return true, nil
+	case "no":
+		return false, nil
+	}
+	return false, errors.Errorf("invalid value %q for %s, must be yes or no", d.Args[0], d.Keyword)
+}
+
+func oneOf(d Directive, values ...string) (string, error) {
+	v := strings.ToLower(d.Args[0])
+	for _, allowed := range values {
+		if v == allowed {
+			return v, nil
+		}
+	}
+	return "", errors.Errorf("invalid value %q for %s, must be one of %s", d.Args[0], d.Keyword, strings.Join(values, ", "))
+}
+
+// timeUnits are the units of the time format of sshd_config.
+var timeUnits = map[byte]time.Duration{
+	's': time.Second,
+	'S': time.Second,
+	'm': time.Minute,
+	'M': time.Minute,
+	'h': time.Hour,
+	'H': time.Hour,
+	'd': 24 * time.Hour,
+	'D': 24 * time.Hour,
+	'w': 7 * 24 * time.Hour,
+	'W': 7 * 24 * time.Hour,
+}
+
+// ParseTime parses times like 90 or 1m30s, which are seconds without a unit.
+func ParseTime(s string) (time.Duration, error) {
+	var total time.Duration
+	for rest := s; rest != ""; {
+		end := strings.IndexFunc(rest, func(r rune) bool { return r < '0' || r > '9' })
+		if end < 0 {
+			end = len(rest)
+		}
+		n, err := strconv.Atoi(rest[:end])
+		if err != nil {
+			return 0, errors.Errorf("invalid time %q", s)
+		}
+
+		unit := time.Second
+		if end < len(rest) {
+			var ok bool
+			if unit, ok = timeUnits[rest[end]]; !ok {
+				return 0, errors.Errorf("invalid time %q", s)
+			}
+			end++
+		}
+
+		total += time.Duration(n) * unit
+		rest = rest[end:]
+	}
+	return total, nil
+}
+
+// apply sets the value of d. Directives go-sshd doesn't support are warned
+// about and ignored.
+func (s *settings) apply(file string, d Directive) error {
+	if !multiple[d.Keyword] {
+		if s.seen[d.Keyword] {
+			return nil
+		}
+		s.seen[d.Keyword] = true
+	}
+
+	var err error
+	switch d.Keyword {
+	case "port":
+		for _, p := range d.Args {
+			if _, err := strconv.ParseUint(p, 10, 16); err != nil {
+				return errors.Errorf("invalid port %q", p)
+			}
+		}
+		s.ports = append(s.ports, d.Args...)
+	case "listenaddress":
+		if len(d.Args) > 1 {
+			warn(file, d, "Routing domains are not supported, ignoring")
+		}
+		s.listenAddresses = append(s.listenAddresses, d.Args[0])
+	case "hostkey":
+		s.hostKeys = append(s.hostKeys, d.Args[0])
+	case "permitrootlogin":
+		s.permitRootLogin, err = sshd.ParseRootLogin(d.Args[0])
+	case "passwordauthentication":
+		s.passwordAuth, err = yesNo(d)
+	case "pubkeyauthentication":
+		s.pubkeyAuth, err = yesNo(d)
+	case "strictmodes":
+		s.strictModes, err = yesNo(d)
+	case "authorizedkeysfile":
+		s.authorizedKeysFiles = d.Args
+		if len(d.Args) == 1 && strings.ToLower(d.Args[0]) == "none" {
+			s.authorizedKeysFiles = nil
+		}
+	case "trustedusercakeys":
+		s.trustedUserCAKeys = d.Args[0]
+		if strings.ToLower(s.trustedUserCAKeys) == "none" {
+			s.trustedUserCAKeys = ""
+		}
+	case "revokedkeys":
+		s.revokedKeys = d.Args[0]
+		if strings.ToLower(s.revokedKeys) == "none" {
+			s.revokedKeys = ""
+		}
+	case "allowusers":
+		s.allowUsers = append(s.allowUsers, d.Args...)
+	case "denyusers":
+		s.denyUsers = append(s.denyUsers, d.Args...)
+	case "allowgroups":
+		s.allowGroups = append(s.allowGroups, d.Args...)
+	case "denygroups":
+		s.denyGroups = append(s.denyGroups, d.Args...)
+	case "forcecommand":
+		s.forceCommand = strings.Join(d.Args, " ")
+		if strings.ToLower(s.forceCommand) == "none" {
+			s.forceCommand = ""
+		}
+	case "banner":
+		s.banner = d.Args[0]
+		if strings.ToLower(s.banner) == "none" {
+			s.banner = ""
+		}
+	case "clientaliveinterval":
+		s.clientAliveInterval, err = ParseTime(d.Args[0])
+	case "clientalivecountmax":
+		s.clientAliveCountMax, err = strconv.Atoi(d.Args[0])
+		if err != nil || s.clientAliveCountMax < 0 {
+			err = errors.Errorf("invalid value %q for %s", d.Args[0], d.Keyword)
+		}
+	case "acceptenv":
+		s.acceptEnv = append(s.acceptEnv, d.Args...)
+	case "permituserenvironment":
+		switch strings.ToLower(d.Args[0]) {
+		case "yes":
+			s.userEnvironment = []string{"*"}
+		case "no":
+			s.userEnvironment = nil
+		default:
+			s.userEnvironment = strings.Split(d.Args[0], ",")
+		}
+	case "allowagentforwarding":
+		s.agentForwarding, err = yesNo(d)
+	case "x11forwarding":
+		s.x11Forwarding, err = yesNo(d)
+	case "allowtcpforwarding":
+		s.tcpForwarding, err = oneOf(d, "yes", "all", "no", "local", "remote")
+	case "gatewayports":
+		s.gatewayPorts, err = oneOf(d, "yes", "no", "clientspecified")
+	case "permitopen":
+		s.permitOpen = d.Args
+	case "permitlisten":
+		s.permitListen = d.Args
+	case "allowstreamlocalforwarding":
+		s.streamLocal, err = oneOf(d, "yes", "all", "no", "local", "remote")
+	case "subsystem":
+		if len(d.Args) < 2 {
+			return errors.New("missing command for Subsystem")
+		}
+		if d.Args[0] != "sftp" {
+			warn(file, d, "Only the sftp subsystem is supported, ignoring")
+			return nil
+		}
+		// Whatever the command, sftp is served in-process.
+		s.sftp = true
+	default:
+		if v, ok := compatible[d.Keyword]; ok && strings.ToLower(d.Args[0]) == v {
+			return nil
+		}
+		warn(file, d, "Unsupported directive, ignoring")
+	}
+
+	return err
+}
+
+// addresses returns the addresses of every ListenAddress and Port.
+func (s *settings) addresses() []string {
+	ports := s.ports
+	if len(ports) == 0 {
+		ports = []string{"22"}
+	}
+
+	hosts := s.listenAddresses
+	if len(hosts) == 0 {
+		hosts = []string{""}
+	}
+
+	var addrs []string
+	for _, h := range hosts {
+		if host, port, err := net.SplitHostPort(h); err == nil {
+			addrs = append(addrs, net.JoinHostPort(host, port))
+			continue
+		}
+
+		h = strings.TrimSuffix(strings.TrimPrefix(h, "["), "]")
+		for _, p := range ports {
+			addrs = append(addrs, net.JoinHostPort(h, p))
+		}
+	}
+
+	return addrs
+}
+
+// usableHostKey reports whether the server can load the host key in file.
+func usableHostKey(file string) error {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	_, err = gossh.ParsePrivateKey(b)
+	return err
+}
+
+// openPolicy translates PermitOpen into a forwarding policy.
+func openPolicy(permitted []string) (sshd.ForwardPolicy, error) {
+	policy := sshd.ForwardPolicy{}
+
+	for _, p := range permitted {
+		switch strings.ToLower(p) {
+		case "any":
+			return sshd.ForwardPolicy{{}}, nil
+		case "none":
+			return sshd.ForwardPolicy{}, nil
+		}
+
+		host, port, err := net.SplitHostPort(p)
+		if err != nil {
+			return nil, errors.Errorf("invalid PermitOpen %q", p)
+		}
+		rule, err := forwardRule(host, port)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid PermitOpen %q", p)
+		}
+		policy = append(policy, rule)
+	}
+
+	return policy, nil
+}
+
+// listenPolicy translates PermitListen and GatewayPorts into a forwarding
+// policy. Without GatewayPorts, only the loopback addresses may be bound.
+func listenPolicy(permitted []string, gatewayPorts string) (sshd.ForwardPolicy, error) {
+	loopback := []string{"localhost", "127.0.0.1", "::1"}
+	if gatewayPorts != "no" {
+		loopback = nil
+	}
+
+	policy := sshd.ForwardPolicy{}
+	for _, p := range permitted {
+		switch strings.ToLower(p) {
+		case "any":
+			return sshd.ForwardPolicy{{Hosts: loopback}}, nil
+		case "none":
+			return sshd.ForwardPolicy{}, nil
+		}
+
+		host, port, err := net.SplitHostPort(p)
+		if err != nil {
+			host, port = "", p
+		}
+		rule, err := forwardRule(host, port)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid PermitListen %q", p)
+		}
+		if rule.Hosts == nil {
+			rule.Hosts = loopback
+		}
+		policy = append(policy, rule)
+	}
+
+	return policy, nil
+}
+
+// localForwarding returns the policy of ssh -L, which is nil if it's
+// disabled.
+func (s *settings) localForwarding() (sshd.ForwardPolicy, error) {
+	switch s.tcpForwarding {
+	case "yes", "all", "local":
+		return openPolicy(s.permitOpen)
+	}
+	return nil, nil
+}
+
+// remoteForwarding returns the policy of ssh -R, which is nil if it's
+// disabled.
+func (s *settings) remoteForwarding() (sshd.ForwardPolicy, error) {
+	switch s.tcpForwarding {
+	case "yes", "all", "remote":
+		return listenPolicy(s.permitListen, s.gatewayPorts)
+	}
+	return nil, nil
+}
+
+// streamLocalForwarding returns the policy of Unix socket forwarding, which is
+// nil if it's disabled.
+func (s *settings) streamLocalForwarding(file string) sshd.StreamLocalPolicy {
+	switch s.streamLocal {
+	case "yes", "all":
+		return sshd.StreamLocalPolicy{{}}
+	case "local", "remote":
+		logrus.WithField("file", file).Warnln("Unix socket forwarding can't be limited to one direction, disabling it")
+	}
+	return nil
+}
+
+// forwardRule allows host and port, either of which may be *.
+func forwardRule(host, port string) (sshd.ForwardRule, error) {
+	rule := sshd.ForwardRule{}
+	if host != "*" && host != "" {
+		rule.Hosts = []string{host}
+	}
+	if port != "*" {
+		n, err := strconv.ParseUint(port, 10, 16)
+		if err != nil {
+			return rule, errors.Errorf("invalid port %q", port)
+		}
+		rule.Ports = []sshd.PortRange{{From: uint32(n), To: uint32(n)}}
+	}
+	return rule, nil
+}
+
+// Options returns the options of the server described by c. The directives
+// go-sshd doesn't support are logged and ignored.
+func (c *Config) Options() ([]sshd.Option, error) {
+	s := defaults()
+	for _, d := range c.Directives {
+		if err := s.apply(c.File, d); err != nil {
+			return nil, errors.Wrapf(err, "%s:%d", c.File, d.Line)
+		}
+	}
+
+	rules, err := c.matchRules(s)
+	if err != nil {
+		return nil, err
+	}
+
+	userStore := &auth.LocalUserStore{}
+	opts := []sshd.Option{
+		sshd.WithUserStore(userStore),
+		sshd.WithPermitRootLogin(s.permitRootLogin),
+		sshd.WithClientAlive(s.clientAliveInterval, s.clientAliveCountMax),
+	}
+
+	opts = append(opts, sshd.WithAddress(s.addresses()...))
+
+	hostKeys := s.hostKeys
+	if len(hostKeys) == 0 {
+		for _, f := range defaultHostKeys {
+			if _, err := os.Stat(f); err == nil {
+				hostKeys = append(hostKeys, f)
+			}
+		}
+	}
+	usable := 0
+	for _, f := range hostKeys {
+		if err := usableHostKey(f); err != nil {
+			logrus.WithField("file", f).WithError(err).Warnln("Unusable host key, ignoring")
+			continue
+		}
+		opts = append(opts, sshd.WithHostFile(f))
+		usable++
+	}
+	if usable == 0 {
+		logrus.WithField("file", c.File).Warnln("No usable host key, generating one")
+	}
+
+	if s.pubkeyAuth {
+		// Files depending on the user are read by a single authenticator,
+		// and the other ones by one each, reloaded when they change.
+		var userFiles []string
+		for _, f := range s.authorizedKeysFiles {
+			if !strings.HasPrefix(f, "/") || strings.Contains(f, "%") {
+				userFiles = append(userFiles, f)
+				continue
+			}
+			if _, err := os.Stat(f); err != nil {
+				logrus.WithField("file", f).WithError(err).Warnln("Missing authorized keys file, ignoring")
+				continue
+			}
+			pkAuth, err := auth.NewLocalPublicKeyAuth(f)
+			if err != nil {
+				return nil, errors.Wrapf(err, "authorized keys file %s", f)
+			}
+			opts = append(opts, sshd.WithAuth(pkAuth))
+		}
+
+		if len(userFiles) > 0 {
+			pkAuth := auth.NewUserPublicKeyAuth(userStore, fsuser.Run, userFiles...)
+			pkAuth.StrictModes = s.strictModes
+			opts = append(opts, sshd.WithAuth(pkAuth))
+		}
+
+		if s.trustedUserCAKeys != "" {
+			pkAuth, err := auth.NewCertPublicKeyAuth(s.trustedUserCAKeys)
+			if err != nil {
+				return nil, errors.Wrapf(err, "trusted user CA keys %s", s.trustedUserCAKeys)
+			}
+			opts = append(opts, sshd.WithAuth(pkAuth))
+		}
+
+		if s.revokedKeys != "" {
+			revoked, err := auth.NewRevokedKeys(s.revokedKeys)
+			if err != nil {
+				return nil, errors.Wrapf(err, "revoked keys %s", s.revokedKeys)
+			}
+			opts = append(opts, sshd.WithRevokedKeys(revoked))
+		}
+	}
+
+	if s.passwordAuth {
+		opts = append(opts, sshd.WithAuth(auth.NewPamPasswordAuth(PAMService)))
+	}
+
+	if len(s.allowUsers) > 0 {
+		opts = append(opts, sshd.WithAllowUsers(s.allowUsers...))
+	}
+	if len(s.denyUsers) > 0 {
+		opts = append(opts, sshd.WithDenyUsers(s.denyUsers...))
+	}
+	if len(s.allowGroups) > 0 {
+		opts = append(opts, sshd.WithAllowGroups(s.allowGroups...))
+	}
+	if len(s.denyGroups) > 0 {
+		opts = append(opts, sshd.WithDenyGroups(s.denyGroups...))
+	}
+
+	if s.forceCommand != "" {
+		opts = append(opts, sshd.WithForceCommand(s.forceCommand))
+	}
+
+	if s.banner != "" {
+		b, err := ioutil.ReadFile(s.banner)
+		if err != nil {
+			return nil, errors.Wrap(err, "read banner")
+		}
+		opts = append(opts, sshd.WithBanner(string(b)))
+	}
+
+	if len(s.acceptEnv) > 0 {
+		opts = append(opts, sshd.WithAcceptEnv(s.acceptEnv...))
+	}
+	if len(s.userEnvironment) > 0 {
+		opts = append(opts, sshd.WithPermitUserEnvironment(s.userEnvironment...))
+	}
+
+	if s.agentForwarding {
+		opts = append(opts, sshd.WithAgentForwarding())
+	}
+
+	if s.x11Forwarding {
+		opts = append(opts, sshd.WithX11Forwarding())
+	}
+
+	local, err := s.localForwarding()
+	if err != nil {
+		return nil, err
+	}
+	if local != nil {
+		opts = append(opts, sshd.WithLocalForwarding(local))
+	}
+
+	remote, err := s.remoteForwarding()
+	if err != nil {
+		return nil, err
+	}
+	if remote != nil {
+		opts = append(opts, sshd.WithRemoteForwarding(remote))
+	}
+
+	if streamLocal := s.streamLocalForwarding(c.File); streamLocal != nil {
+		opts = append(opts, sshd.WithStreamLocalForwarding(streamLocal))
+	}
+
+	if s.sftp {
+		opts = append(opts, sshd.WithSubsystem("sftp", sshd.ServeSFTP))
+	}
+
+	if len(rules) > 0 {
+		opts = append(opts, sshd.WithMatch(rules...))
+	}
+
+	return opts, nil
+}
@@ -0,0 +1,187 @@
+// Package sshdconfig reads OpenSSH sshd_config files, and translates the
+// directives go-sshd supports into options for sshd.NewServer, so the daemon
+// can replace OpenSSH with its existing configuration.
+package sshdconfig
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Directive is a keyword and its arguments. Keywords are case insensitive,
+// and stored in lower case.
+type Directive struct {
+	Keyword string
+	Args    []string
+	Line    int
+}
+
+// Criterion is a criterion of a Match line, like User alice,bob. All has no
+// value.
+type Criterion struct {
+	Name  string
+	Value string
+}
+
+// Match is a Match block, whose directives apply to the connections matching
+// all of its criteria.
+type Match struct {
+	Criteria   []Criterion
+	Directives []Directive
+	Line       int
+}
+
+// Config is a parsed sshd_config file. Directives are the global directives,
+// in the order of the file.
+type Config struct {
+	File       string
+	Directives []Directive
+	Matches    []Match
+}
+
+// Load reads the sshd_config file at path.
+func Load(path string) (*Config, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "read sshd_config")
+	}
+	defer f.Close()
+
+	return Parse(f, path)
+}
+
+// Parse reads an sshd_config file from r. name is only used in errors and
+// warnings.
+func Parse(r io.Reader, name string) (*Config, error) {
+	c := &Config{File: name}
+
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		keyword, args, err := splitLine(scanner.Text())
+		if err != nil {
+			return nil, errors.Wrapf(err, "%s:%d", name, line)
+		}
+		if keyword == "" {
+			continue
+		}
+
+		d := Directive{Keyword: strings.ToLower(keyword), Args: args, Line: line}
+		if d.Keyword == "match" {
+			criteria, err := parseCriteria(args)
+			if err != nil {
+				return nil, errors.Wrapf(err, "%s:%d", name, line)
+			}
+			c.Matches = append(c.Matches, Match{Criteria: criteria, Line: line})
+			continue
+		}
+
+		if len(args) == 0 {
+			return nil, errors.Errorf("%s:%d: missing argument for %s", name, line, keyword)
+		}
+
+		// Everything after a Match line belongs to it, up to the next
+		// Match line.
+		if n := len(c.Matches); n > 0 {
+			c.Matches[n-1].Directives = append(c.Matches[n-1].Directives, d)
+		} else {
+			c.Directives = append(c.Directives, d)
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, errors.Wrapf(err, "read %s", name)
+	}
+
+	return c, nil
+}
+
+// splitLine splits a line into its keyword and arguments. Like OpenSSH, the
+// keyword may be followed by an equal sign, arguments may be quoted with
+// double quotes, and comments start with # at the beginning of an argument.
+func splitLine(line string) (string, []string, error) {
+	line = strings.TrimSpace(line)
+	if line == "" || line[0] == '#' {
+		return "", nil, nil
+	}
+
+	end := strings.IndexAny(line, " \t=")
+	if end < 0 {
+		return line, nil, nil
+	}
+	keyword, rest := line[:end], strings.TrimLeft(line[end:], " \t")
+	if strings.HasPrefix(rest, "=") {
+		rest = strings.TrimLeft(rest[1:], " \t")
+	}
+
+	var args []string
+	for rest != "" {
+		if rest[0] == '#' {
+			break
+		}
+
+		var arg string
+		if rest[0] == '"' {
+			end := strings.IndexByte(rest[1:], '"')
+			if end < 0 {
+				return "", nil, errors.New("unterminated quote")
+			}
+			arg, rest = rest[1:end+1], rest[end+2:]
+		} else {
+			end := strings.IndexAny(rest, " \t")
+			if end < 0 {
+				end = len(rest)
+			}
+			arg, rest = rest[:end], rest[end:]
+		}
+
+		args = append(args, arg)
+		rest = strings.TrimLeft(rest, " \t")
+	}
+
+	return keyword, args, nil
+}
+
+// criteria are the Match criteria go-sshd knows about.
+var criteria = map[string]bool{
+	"all":          true,
+	"user":         true,
+	"group":        true,
+	"host":         true,
+	"address":      true,
+	"localaddress": true,
+	"localport":    true,
+}
+
+func parseCriteria(args []string) ([]Criterion, error) {
+	if len(args) == 0 {
+		return nil, errors.New("missing criteria for Match")
+	}
+
+	var cs []Criterion
+	for i := 0; i < len(args); i++ {
+		name := strings.ToLower(args[i])
+		if !criteria[name] {
+			return nil, errors.Errorf("unsupported Match criterion %s", args[i])
+		}
+
+		if name == "all" {
+			if len(args) != 1 {
+				return nil, errors.New("Match All must be the only criterion")
+			}
+			cs = append(cs, Criterion{Name: name})
+			continue
+		}
+
+		if i+1 == len(args) {
+			return nil, errors.Errorf("missing value for Match criterion %s", args[i])
+		}
+		i++
+		cs = append(cs, Criterion{Name: name, Value: args[i]})
+	}
+
+	return cs, nil
+}
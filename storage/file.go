@@ -22,12 +22,25 @@ type StorageFile struct {
 	dir string
 }
 
+// New creates the file of a session. Files are never reused, so sessions
+// starting at the same time, in this process or in another one writing to the
+// same directory during an upgrade, don't overwrite each other.
 func (s *StorageFile) New(ctx ssh.Context) (io.WriteCloser, error) {
-	fname := fmt.Sprintf("%d_%s_%s.jsonl",
+	name := fmt.Sprintf("%d_%s_%s",
 		time.Now().Unix(),
 		ctx.User(),
 		ctx.RemoteAddr().String(),
 	)
 
-	return os.OpenFile(filepath.Join(s.dir, fname), os.O_CREATE|os.O_WRONLY, 0660)
+	fname := name + ".jsonl"
+	for i := 1; ; i++ {
+		f, err := os.OpenFile(filepath.Join(s.dir, fname), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0660)
+		if err == nil {
+			return f, nil
+		}
+		if !os.IsExist(err) {
+			return nil, err
+		}
+		fname = fmt.Sprintf("%s_%d.jsonl", name, i)
+	}
 }
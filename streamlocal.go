@@ -0,0 +1,243 @@
+package sshd
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/gliderlabs/ssh"
+	"github.com/inoc603/go-sshd/auth"
+	"github.com/inoc603/go-sshd/fsuser"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// StreamLocalRule allows or denies forwarding of the Unix sockets it matches
+// for the users it lists. An empty field matches everything.
+type StreamLocalRule struct {
+	Deny bool
+
+	// Users are the names of the users the rule applies to.
+	Users []string
+
+	// Paths are glob patterns matched against the absolute path of the
+	// socket, like /run/user/*/docker.sock.
+	Paths []string
+}
+
+// StreamLocalPolicy decides which Unix sockets may be forwarded. The first
+// rule matching a socket decides, and sockets matching no rule are denied.
+type StreamLocalPolicy []StreamLocalRule
+
+// Allowed reports whether user may forward the socket at path.
+func (p StreamLocalPolicy) Allowed(user, path string) bool {
+	for _, r := range p {
+		if matchAny(r.Users, user) && matchAny(r.Paths, path) {
+			return !r.Deny
+		}
+	}
+	return false
+}
+
+// directStreamLocal is the payload of a direct-streamlocal@openssh.com
+// channel, as specified in section 2.4 of OpenSSH's PROTOCOL.
+type directStreamLocal struct {
+	SocketPath string
+	Reserved0  string
+	Reserved1  uint32
+}
+
+// streamLocalForward is the payload of streamlocal-forward@openssh.com and
+// cancel-streamlocal-forward@openssh.com requests.
+type streamLocalForward struct {
+	SocketPath string
+}
+
+// forwardedStreamLocal is the payload of a forwarded-streamlocal@openssh.com
+// channel.
+type forwardedStreamLocal struct {
+	SocketPath string
+	Reserved0  string
+}
+
+// socketPath resolves the path sent by the client against the user's home
+// directory.
+func socketPath(user *auth.User, p string) string {
+	if !filepath.IsAbs(p) {
+		p = filepath.Join(user.Home, p)
+	}
+	return filepath.Clean(p)
+}
+
+// userSocket is a Unix socket created for a user. Closing it removes it with
+// the credentials of the user, as root could otherwise be made to remove
+// another file if the user replaced a directory of the path with a symbolic
+// link.
+type userSocket struct {
+	*net.UnixListener
+	user *auth.User
+	path string
+}
+
+// listenUser creates the Unix socket at path with the credentials of user,
+// only accessible by them.
+func listenUser(user *auth.User, path string) (*userSocket, error) {
+	var ln *net.UnixListener
+	err := fsuser.Run(user, func() error {
+		l, err := net.Listen("unix", path)
+		if err != nil {
+			return err
+		}
+		ln = l.(*net.UnixListener)
+		ln.SetUnlinkOnClose(false)
+
+		if err := os.Chmod(path, 0600); err != nil {
+			ln.Close()
+			os.Remove(path)
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &userSocket{UnixListener: ln, user: user, path: path}, nil
+}
+
+func (l *userSocket) Close() error {
+	err := l.UnixListener.Close()
+	if rerr := fsuser.Run(l.user, func() error {
+		return os.Remove(l.path)
+	}); err == nil && rerr != nil && !os.IsNotExist(rerr) {
+		err = rerr
+	}
+	return err
+}
+
+// handleDirectStreamLocal opens a tunnel to a Unix socket for ssh -L. The
+// socket is connected to with the credentials of the user, so users can only
+// reach sockets they could open themselves.
+func (s *Server) handleDirectStreamLocal(srv *ssh.Server, conn *gossh.ServerConn, newChan gossh.NewChannel, ctx ssh.Context) {
+	policy := s.settings(ctx).streamLocalForwarding
+	if policy == nil {
+		newChan.Reject(gossh.Prohibited, "socket forwarding is not allowed")
+		return
+	}
+
+	var d directStreamLocal
+	if err := gossh.Unmarshal(newChan.ExtraData(), &d); err != nil {
+		newChan.Reject(gossh.ConnectionFailed, "error parsing forward data: "+err.Error())
+		return
+	}
+
+	user, err := s.userStore.Get(ctx.User())
+	if err != nil {
+		newChan.Reject(gossh.ConnectionFailed, "failed to get user")
+		return
+	}
+
+	path := socketPath(user, d.SocketPath)
+	l := logrus.WithFields(logrus.Fields{
+		"user":       ctx.User(),
+		"session_id": ctx.SessionID(),
+		"socket":     path,
+	})
+
+	if !policy.Allowed(ctx.User(), path) {
+		l.Warnln("Socket forwarding denied")
+		newChan.Reject(gossh.Prohibited, "socket forwarding is not allowed")
+		return
+	}
+
+	var dconn net.Conn
+	err = fsuser.Run(user, func() (err error) {
+		dconn, err = net.Dial("unix", path)
+		return err
+	})
+	if err != nil {
+		l.WithError(err).Warnln("Failed to connect to forwarded socket")
+		newChan.Reject(gossh.ConnectionFailed, err.Error())
+		return
+	}
+
+	ch, reqs, err := newChan.Accept()
+	if err != nil {
+		dconn.Close()
+		return
+	}
+	go gossh.DiscardRequests(reqs)
+
+	s.tunnel(ctx, "direct-streamlocal@openssh.com", ch, dconn, map[string]interface{}{
+		"socket": path,
+	})
+}
+
+// handleStreamLocalForward creates a Unix socket for ssh -R, and forwards the
+// connections it accepts back to the client. The socket is created with the
+// credentials of the user and is only accessible by them.
+func (s *Server) handleStreamLocalForward(ctx ssh.Context, srv *ssh.Server, req *gossh.Request) (bool, []byte) {
+	policy := s.settings(ctx).streamLocalForwarding
+	if policy == nil {
+		return false, nil
+	}
+
+	var r streamLocalForward
+	if err := gossh.Unmarshal(req.Payload, &r); err != nil {
+		return false, nil
+	}
+
+	user, err := s.userStore.Get(ctx.User())
+	if err != nil {
+		return false, nil
+	}
+
+	path := socketPath(user, r.SocketPath)
+	l := logrus.WithFields(logrus.Fields{
+		"user":       ctx.User(),
+		"session_id": ctx.SessionID(),
+		"socket":     path,
+	})
+
+	if !policy.Allowed(ctx.User(), path) {
+		l.Warnln("Socket forwarding denied")
+		return false, nil
+	}
+
+	ln, err := listenUser(user, path)
+	if err != nil {
+		l.WithError(err).Warnln("Failed to listen for socket forwarding")
+		return false, nil
+	}
+
+	if !getRemoteForwards(ctx).add(ctx, path, ln) {
+		ln.Close()
+		return false, nil
+	}
+
+	go s.acceptForwards(ctx, ln, "forwarded-streamlocal@openssh.com", l, func(c net.Conn) ([]byte, map[string]interface{}) {
+		payload := gossh.Marshal(&forwardedStreamLocal{SocketPath: r.SocketPath})
+
+		return payload, map[string]interface{}{
+			"socket": path,
+		}
+	})
+
+	return true, nil
+}
+
+// handleCancelStreamLocalForward closes and removes a socket created by
+// handleStreamLocalForward.
+func (s *Server) handleCancelStreamLocalForward(ctx ssh.Context, srv *ssh.Server, req *gossh.Request) (bool, []byte) {
+	var r streamLocalForward
+	if err := gossh.Unmarshal(req.Payload, &r); err != nil {
+		return false, nil
+	}
+
+	user, err := s.userStore.Get(ctx.User())
+	if err != nil {
+		return false, nil
+	}
+
+	return getRemoteForwards(ctx).remove(socketPath(user, r.SocketPath)), nil
+}
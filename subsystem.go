@@ -0,0 +1,61 @@
+package sshd
+
+import (
+	"github.com/Sirupsen/logrus"
+	"github.com/gliderlabs/ssh"
+	"github.com/inoc603/go-sshd/auth"
+	"github.com/pkg/errors"
+)
+
+// SubsystemHandler serves a subsystem for an authenticated user. What the
+// client does in the subsystem should be reported through record.
+type SubsystemHandler func(session ssh.Session, user *auth.User, record func(e Event)) error
+
+func (s *Server) serveSubsystem(session ssh.Session, h SubsystemHandler) error {
+	user, err := s.userStore.Get(session.User())
+	if err != nil {
+		return errors.Wrap(err, "find user")
+	}
+
+	rec, closeRecorder, err := s.recorder(session)
+	if err != nil {
+		return errors.Wrap(err, "failed to create recorder")
+	}
+	defer closeRecorder()
+
+	return h(session, user, func(e Event) {
+		s.recordEvent(session.Context().(ssh.Context), rec, e)
+	})
+}
+
+func (s *Server) handleSubsystem(h SubsystemHandler) ssh.SubsystemHandler {
+	return func(session ssh.Session) {
+		l := logrus.WithFields(logrus.Fields{
+			"user":       session.User(),
+			"subsystem":  session.Subsystem(),
+			"session_id": session.Context().(ssh.Context).SessionID(),
+		})
+		l.Infoln("Subsystem started")
+
+		settings := s.settings(session.Context().(ssh.Context))
+		if settings.forceCommand != "" {
+			s.handleSSH(session)
+			return
+		}
+
+		if settings.subsystems != nil && !contains(settings.subsystems, session.Subsystem()) {
+			l.Warnln("Subsystem not allowed")
+			session.Exit(1)
+			return
+		}
+
+		if err := s.serveSubsystem(session, h); err != nil {
+			l.WithError(err).Errorln("Subsystem ended")
+			session.Exit(1)
+			return
+		}
+
+		l.Infoln("Subsystem ended")
+		session.Exit(0)
+	}
+}
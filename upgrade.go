@@ -0,0 +1,165 @@
+package sshd
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/pkg/errors"
+)
+
+const (
+	// envParentPID is set by Upgrade instead of LISTEN_PID, which can't be
+	// known before the new process starts.
+	envParentPID = "GO_SSHD_PARENT_PID"
+
+	// envReadyFD is the file descriptor the new process closes once it
+	// listens.
+	envReadyFD = "GO_SSHD_READY_FD"
+)
+
+type filer interface {
+	File() (*os.File, error)
+}
+
+// Upgrade starts a new process of the running executable, with the same
+// arguments, which serves the listeners of the server. It returns once the new
+// process listens, leaving the server as it is: Drain then lets the sessions
+// of the old process end while the new one accepts the connections.
+func (s *Server) Upgrade(ctx context.Context) error {
+	s.mu.Lock()
+	listeners := append([]net.Listener{}, s.active...)
+	s.mu.Unlock()
+	if len(listeners) == 0 {
+		return errors.New("not listening")
+	}
+
+	var files []*os.File
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	for _, l := range listeners {
+		fl, ok := l.(filer)
+		if !ok {
+			return errors.Errorf("can't pass on listener %s", l.Addr())
+		}
+		f, err := fl.File()
+		if err != nil {
+			return errors.Wrapf(err, "pass on listener %s", l.Addr())
+		}
+		files = append(files, f)
+	}
+
+	exe, err := os.Executable()
+	if err != nil {
+		return errors.Wrap(err, "find executable")
+	}
+
+	ready, notify, err := os.Pipe()
+	if err != nil {
+		return errors.Wrap(err, "create pipe")
+	}
+	defer ready.Close()
+
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	cmd.ExtraFiles = append(files, notify)
+	cmd.Env = append(environWithout("LISTEN_PID", "LISTEN_FDS", "LISTEN_FDNAMES", envParentPID, envReadyFD),
+		"LISTEN_FDS="+strconv.Itoa(len(files)),
+		envParentPID+"="+strconv.Itoa(os.Getpid()),
+		envReadyFD+"="+strconv.Itoa(listenFdsStart+len(files)),
+	)
+
+	err = cmd.Start()
+	notify.Close()
+	if err != nil {
+		return errors.Wrap(err, "start new process")
+	}
+	go cmd.Wait()
+
+	l := logrus.WithField("pid", cmd.Process.Pid)
+	l.Infoln("Started new process")
+
+	// The pipe is closed by the new process once it listens, or when it
+	// exits, and only written to in the first case.
+	done := make(chan bool, 1)
+	go func() {
+		b := make([]byte, 1)
+		n, _ := ready.Read(b)
+		done <- n == 1
+	}()
+
+	select {
+	case ok := <-done:
+		if !ok {
+			return errors.New("new process exited before listening")
+		}
+	case <-ctx.Done():
+		cmd.Process.Kill()
+		return errors.Wrap(ctx.Err(), "wait for new process")
+	}
+
+	// The sockets belong to the new process now, so closing the listeners
+	// mustn't remove them. Until then, they are removed as usual if the new
+	// process fails.
+	for _, ln := range listeners {
+		if ul, ok := ln.(*net.UnixListener); ok {
+			ul.SetUnlinkOnClose(false)
+		}
+	}
+
+	l.Infoln("New process is listening")
+	return nil
+}
+
+// notifyReady tells the process which started this one that it listens, and
+// systemd that this process is the main one.
+func notifyReady() {
+	if fd, err := strconv.Atoi(os.Getenv(envReadyFD)); err == nil {
+		f := os.NewFile(uintptr(fd), "ready")
+		f.Write([]byte{1})
+		f.Close()
+	}
+	os.Unsetenv(envReadyFD)
+
+	sdNotify(fmt.Sprintf("READY=1\nMAINPID=%d", os.Getpid()))
+}
+
+// sdNotify sends state to systemd, when it runs the server with Type=notify.
+func sdNotify(state string) {
+	addr := os.Getenv("NOTIFY_SOCKET")
+	if addr == "" {
+		return
+	}
+
+	conn, err := net.Dial("unixgram", addr)
+	if err != nil {
+		logrus.WithError(err).Warnln("Failed to notify systemd")
+		return
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte(state)); err != nil {
+		logrus.WithError(err).Warnln("Failed to notify systemd")
+	}
+}
+
+// environWithout returns the environment of the process without the
+// variables names.
+func environWithout(names ...string) []string {
+	var env []string
+	for _, kv := range os.Environ() {
+		name := strings.SplitN(kv, "=", 2)[0]
+		if !contains(names, name) {
+			env = append(env, kv)
+		}
+	}
+	return env
+}
@@ -0,0 +1,217 @@
+package sshd
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/gliderlabs/ssh"
+	"github.com/inoc603/go-sshd/auth"
+	"github.com/pkg/errors"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+const (
+	// x11DisplayOffset is the first display number used for forwarding, like
+	// OpenSSH's X11DisplayOffset, so displays of the host itself are left alone.
+	x11DisplayOffset = 10
+	x11MaxDisplays   = 1000
+	x11AuthProtocol  = "MIT-MAGIC-COOKIE-1"
+)
+
+// x11Channel is the payload of an x11 channel, as specified in RFC 4254,
+// section 6.3.2.
+type x11Channel struct {
+	OriginAddr string
+	OriginPort uint32
+}
+
+// allowX11 accepts x11-req requests carrying a cookie that can be spoofed.
+func (s *Server) allowX11(ctx ssh.Context, x11 ssh.X11) bool {
+	if !s.settings(ctx).x11Forwarding || x11.AuthProtocol != x11AuthProtocol {
+		return false
+	}
+	cookie, err := hex.DecodeString(x11.AuthCookie)
+	return err == nil && len(cookie) > 0
+}
+
+// listenX11 listens on the TCP port of the first free display.
+func listenX11() (net.Listener, int, error) {
+	for display := x11DisplayOffset; display < x11DisplayOffset+x11MaxDisplays; display++ {
+		ln, err := net.Listen("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(6000+display)))
+		if err == nil {
+			return ln, display, nil
+		}
+	}
+	return nil, 0, errors.New("no free display")
+}
+
+// xauthority returns the authority file of user.
+func xauthority(user *auth.User) string {
+	return filepath.Join(user.Home, ".Xauthority")
+}
+
+// xauth runs the xauth commands given by script as user, on their authority
+// file.
+func xauth(user *auth.User, script string) error {
+	cmd := exec.Command("xauth", "-q", "-f", xauthority(user), "-")
+	cmd.Env = []string{"HOME=" + user.Home, "PATH=/usr/bin:/bin:/usr/X11R6/bin"}
+	cmd.Dir = user.Home
+	cmd.Stdin = strings.NewReader(script)
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Credential: credential(user),
+	}
+
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return errors.Wrapf(err, "xauth: %s", bytes.TrimSpace(out))
+	}
+	return nil
+}
+
+// forwardX11 allocates a display for the session and forwards the X clients
+// connecting to it back to the client. Like OpenSSH, the user's authority
+// file gets a fake cookie, which is replaced by the real one as connections
+// are forwarded, so the real cookie never leaves the client. It returns the
+// value of DISPLAY, and a function to stop forwarding once the session is
+// over.
+func (s *Server) forwardX11(session ssh.Session, user *auth.User, req ssh.X11) (string, func(), error) {
+	ctx := session.Context().(ssh.Context)
+
+	cookie, err := hex.DecodeString(req.AuthCookie)
+	if err != nil {
+		return "", nil, errors.Wrap(err, "decode x11 cookie")
+	}
+	fake := make([]byte, len(cookie))
+	if _, err := rand.Read(fake); err != nil {
+		return "", nil, errors.Wrap(err, "generate x11 cookie")
+	}
+
+	ln, display, err := listenX11()
+	if err != nil {
+		return "", nil, err
+	}
+
+	l := logrus.WithFields(logrus.Fields{
+		"user":       session.User(),
+		"session_id": ctx.SessionID(),
+		"display":    display,
+	})
+
+	authDisplay := fmt.Sprintf("unix:%d.%d", display, req.ScreenNumber)
+	script := fmt.Sprintf("remove %s\nadd %s %s %x\n", authDisplay, authDisplay, req.AuthProtocol, fake)
+	if err := xauth(user, script); err != nil {
+		l.WithError(err).Warnln("Failed to add x11 cookie")
+	}
+
+	l.Infoln("X11 forwarding started")
+
+	go func() {
+		conn := ctx.Value(ssh.ContextKeyConn).(gossh.Conn)
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			if req.SingleConnection {
+				ln.Close()
+			}
+
+			go s.forwardX11Conn(ctx, conn, c, req.AuthProtocol, fake, cookie, l)
+		}
+	}()
+
+	return fmt.Sprintf("localhost:%d.%d", display, req.ScreenNumber), func() {
+		ln.Close()
+		l.Infoln("X11 forwarding stopped")
+	}, nil
+}
+
+// forwardX11Conn forwards an X client connection to the client, once it has
+// authenticated with the fake cookie.
+func (s *Server) forwardX11Conn(ctx ssh.Context, conn gossh.Conn, c net.Conn, proto string, fake, cookie []byte, l *logrus.Entry) {
+	c.SetReadDeadline(time.Now().Add(30 * time.Second))
+	setup, err := spoofX11Auth(c, proto, fake, cookie)
+	c.SetReadDeadline(time.Time{})
+	if err != nil {
+		l.WithError(err).Warnln("Rejected x11 connection")
+		c.Close()
+		return
+	}
+
+	originAddr, originPort, _ := net.SplitHostPort(c.RemoteAddr().String())
+	port, _ := strconv.Atoi(originPort)
+
+	ch, reqs, err := conn.OpenChannel("x11", gossh.Marshal(&x11Channel{
+		OriginAddr: originAddr,
+		OriginPort: uint32(port),
+	}))
+	if err != nil {
+		l.WithError(err).Warnln("Failed to open x11 channel")
+		c.Close()
+		return
+	}
+	go gossh.DiscardRequests(reqs)
+
+	if _, err := ch.Write(setup); err != nil {
+		ch.Close()
+		c.Close()
+		return
+	}
+
+	s.tunnel(ctx, "x11", ch, c, map[string]interface{}{
+		"originator": c.RemoteAddr().String(),
+	})
+}
+
+func pad4(n int) int {
+	return (n + 3) &^ 3
+}
+
+// spoofX11Auth reads the connection setup of an X client, checks that it
+// authenticates with the fake cookie, and returns it with the real cookie in
+// its place.
+func spoofX11Auth(r io.Reader, proto string, fake, cookie []byte) ([]byte, error) {
+	header := make([]byte, 12)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, errors.Wrap(err, "read x11 setup")
+	}
+
+	var order binary.ByteOrder
+	switch header[0] {
+	case 'B':
+		order = binary.BigEndian
+	case 'l':
+		order = binary.LittleEndian
+	default:
+		return nil, errors.Errorf("invalid x11 byte order %q", header[0])
+	}
+
+	nameLen := int(order.Uint16(header[6:]))
+	dataLen := int(order.Uint16(header[8:]))
+
+	auth := make([]byte, pad4(nameLen)+pad4(dataLen))
+	if _, err := io.ReadFull(r, auth); err != nil {
+		return nil, errors.Wrap(err, "read x11 setup")
+	}
+
+	name := auth[:nameLen]
+	data := auth[pad4(nameLen) : pad4(nameLen)+dataLen]
+	if string(name) != proto || subtle.ConstantTimeCompare(data, fake) != 1 {
+		return nil, errors.New("invalid x11 authentication")
+	}
+	copy(data, cookie)
+
+	return append(header, auth...), nil
+}